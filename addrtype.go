@@ -0,0 +1,185 @@
+package btcharness
+
+import (
+	"fmt"
+
+	"github.com/jfixby/coinharness"
+	"github.com/picfight/pfcd/chaincfg"
+	"github.com/picfight/pfcd/chaincfg/chainec"
+	"github.com/picfight/pfcd/dcrec"
+	"github.com/picfight/pfcd/dcrec/edwards"
+	"github.com/picfight/pfcd/dcrec/secp256k1"
+	"github.com/picfight/pfcd/dcrutil"
+	"github.com/picfight/pfcd/txscript"
+)
+
+// AddressType is a kind of address derived from a key of the harness. The keys
+// of the Ed25519 and the Schnorr signature suites share the secret of the
+// secp256k1 key they are derived from.
+type AddressType int
+
+const (
+	// P2PKHAddress pays to the hash of the secp256k1 public key, the
+	// address type of PrivateKeyKeyToAddr()
+	P2PKHAddress AddressType = iota
+
+	// P2PKAddress pays to the secp256k1 public key
+	P2PKAddress
+
+	// P2SHAddress pays to the hash of the script paying to the secp256k1
+	// public key, see KeyRedeemScript()
+	P2SHAddress
+
+	// Ed25519P2PKHAddress pays to the hash of the Ed25519 public key
+	Ed25519P2PKHAddress
+
+	// Ed25519P2PKAddress pays to the Ed25519 public key
+	Ed25519P2PKAddress
+
+	// SchnorrP2PKHAddress pays to the hash of the public key verifying
+	// secp256k1 Schnorr signatures
+	SchnorrP2PKHAddress
+
+	// SchnorrP2PKAddress pays to the public key verifying secp256k1
+	// Schnorr signatures
+	SchnorrP2PKAddress
+)
+
+// AddressTypes lists every AddressType
+var AddressTypes = []AddressType{
+	P2PKHAddress,
+	P2PKAddress,
+	P2SHAddress,
+	Ed25519P2PKHAddress,
+	Ed25519P2PKAddress,
+	SchnorrP2PKHAddress,
+	SchnorrP2PKAddress,
+}
+
+// String returns the name of the address type.
+func (t AddressType) String() string {
+	switch t {
+	case P2PKHAddress:
+		return "P2PKHAddress"
+	case P2PKAddress:
+		return "P2PKAddress"
+	case P2SHAddress:
+		return "P2SHAddress"
+	case Ed25519P2PKHAddress:
+		return "Ed25519P2PKHAddress"
+	case Ed25519P2PKAddress:
+		return "Ed25519P2PKAddress"
+	case SchnorrP2PKHAddress:
+		return "SchnorrP2PKHAddress"
+	case SchnorrP2PKAddress:
+		return "SchnorrP2PKAddress"
+	}
+	return fmt.Sprintf("AddressType(%d)", int(t))
+}
+
+// SignatureType returns the signature suite of the key unlocking the outputs
+// paying to addresses of the type.
+func (t AddressType) SignatureType() dcrec.SignatureType {
+	switch t {
+	case Ed25519P2PKHAddress, Ed25519P2PKAddress:
+		return dcrec.STEd25519
+	case SchnorrP2PKHAddress, SchnorrP2PKAddress:
+		return dcrec.STSchnorrSecp256k1
+	}
+	return dcrec.STEcdsaSecp256k1
+}
+
+// KeyAddress returns the address of the passed type receiving to the key.
+func KeyAddress(key coinharness.PrivateKey, addrType AddressType, net coinharness.Network) (coinharness.Address, error) {
+	addr, _, err := keyAddress(key.(*PrivateKey).legacy, addrType,
+		net.Params().(*chaincfg.Params))
+	if err != nil {
+		return nil, err
+	}
+	return &Address{Address: addr}, nil
+}
+
+// KeyToAddrFunc returns the function deriving addresses of the passed type,
+// which has the signature of InMemoryWallet.PrivateKeyKeyToAddr.
+func KeyToAddrFunc(addrType AddressType) func(coinharness.PrivateKey, coinharness.Network) (coinharness.Address, error) {
+	return func(key coinharness.PrivateKey, net coinharness.Network) (coinharness.Address, error) {
+		return KeyAddress(key, addrType, net)
+	}
+}
+
+// KeyRedeemScript returns the redeem script of the P2SHAddress of the key, the
+// script paying to its compressed secp256k1 public key.
+func KeyRedeemScript(key coinharness.PrivateKey) ([]byte, error) {
+	return keyRedeemScript(key.(*PrivateKey).legacy)
+}
+
+func keyRedeemScript(key *secp256k1.PrivateKey) ([]byte, error) {
+	return pubKeyRedeemScript((*secp256k1.PublicKey)(&key.PublicKey))
+}
+
+func pubKeyRedeemScript(pubKey *secp256k1.PublicKey) ([]byte, error) {
+	return txscript.NewScriptBuilder().
+		AddData(pubKey.SerializeCompressed()).
+		AddOp(txscript.OP_CHECKSIG).
+		Script()
+}
+
+// pubKeyAddress returns the address of the passed type receiving to the
+// secp256k1 public key. The Ed25519 keys are derived from the private key, so
+// the Ed25519 address types are not supported.
+func pubKeyAddress(pubKey *secp256k1.PublicKey, addrType AddressType, net *chaincfg.Params) (dcrutil.Address, error) {
+	// Schnorr signatures are verified by the same secp256k1 public key.
+	serialized := pubKey.SerializeCompressed()
+	switch addrType {
+	case P2PKHAddress, SchnorrP2PKHAddress:
+		return dcrutil.NewAddressPubKeyHash(dcrutil.Hash160(serialized),
+			net, addrType.SignatureType())
+	case P2PKAddress:
+		return dcrutil.NewAddressSecpPubKey(serialized, net)
+	case SchnorrP2PKAddress:
+		return dcrutil.NewAddressSecSchnorrPubKey(serialized, net)
+	case P2SHAddress:
+		redeemScript, err := pubKeyRedeemScript(pubKey)
+		if err != nil {
+			return nil, err
+		}
+		return dcrutil.NewAddressScriptHash(redeemScript, net)
+	case Ed25519P2PKHAddress, Ed25519P2PKAddress:
+		return nil, fmt.Errorf("%v is derived from the private key", addrType)
+	}
+	return nil, fmt.Errorf("unknown address type %v", addrType)
+}
+
+// keyAddress returns the address of the passed type receiving to the key along
+// with the private key of its signature suite.
+func keyAddress(key *secp256k1.PrivateKey, addrType AddressType, net *chaincfg.Params) (dcrutil.Address, chainec.PrivateKey, error) {
+	switch addrType {
+	case Ed25519P2PKHAddress, Ed25519P2PKAddress:
+		edKey, edPubKey := edwards.PrivKeyFromSecret(edwards.Edwards(),
+			key.Serialize())
+		if edKey == nil {
+			return nil, nil, fmt.Errorf("failed to derive the " +
+				"Ed25519 key")
+		}
+		serialized := edPubKey.Serialize()
+		var addr dcrutil.Address
+		var err error
+		if addrType == Ed25519P2PKAddress {
+			addr, err = dcrutil.NewAddressEdwardsPubKey(serialized, net)
+		} else {
+			addr, err = dcrutil.NewAddressPubKeyHash(
+				dcrutil.Hash160(serialized), net, dcrec.STEd25519)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		// The Edwards signer of chainec expects the key by value.
+		return addr, *edKey, nil
+	}
+	addr, err := pubKeyAddress((*secp256k1.PublicKey)(&key.PublicKey),
+		addrType, net)
+	if err != nil {
+		return nil, nil, err
+	}
+	return addr, key, nil
+}
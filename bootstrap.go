@@ -0,0 +1,107 @@
+package btcharness
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/picfight/pfcd/chaincfg"
+	"github.com/picfight/pfcd/dcrutil"
+	"github.com/picfight/pfcd/wire"
+)
+
+// WriteBootstrap serializes the passed blocks in the bootstrap format consumed
+// by the node's block import utilities: each block is prefixed with the
+// network magic and the block length, both as little-endian uint32.
+func WriteBootstrap(w io.Writer, blocks []*dcrutil.Block, net *chaincfg.Params) error {
+	var prefix [8]byte
+	binary.LittleEndian.PutUint32(prefix[0:4], uint32(net.Net))
+	for _, block := range blocks {
+		blockBytes, err := block.Bytes()
+		if err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint32(prefix[4:8], uint32(len(blockBytes)))
+		if _, err := w.Write(prefix[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(blockBytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteBootstrapFile creates (or truncates) the named file and writes the
+// passed blocks to it with WriteBootstrap.
+func WriteBootstrapFile(path string, blocks []*dcrutil.Block, net *chaincfg.Params) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	if err := WriteBootstrap(writer, blocks, net); err != nil {
+		file.Close()
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ReadBootstrapBlock reads the next block written by WriteBootstrap. io.EOF is
+// returned when there are no more blocks.
+func ReadBootstrapBlock(r io.Reader, net *chaincfg.Params) (*dcrutil.Block, error) {
+	var prefix [8]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("truncated block prefix")
+		}
+		return nil, err
+	}
+	magic := wire.CurrencyNet(binary.LittleEndian.Uint32(prefix[0:4]))
+	if magic != net.Net {
+		return nil, fmt.Errorf("block network %v does not match %v",
+			magic, net.Net)
+	}
+	blockLen := binary.LittleEndian.Uint32(prefix[4:8])
+	if blockLen > wire.MaxBlockPayload {
+		return nil, fmt.Errorf("block length %v exceeds the maximum "+
+			"block payload %v", blockLen, wire.MaxBlockPayload)
+	}
+	blockBytes := make([]byte, blockLen)
+	if _, err := io.ReadFull(r, blockBytes); err != nil {
+		return nil, fmt.Errorf("truncated block: %v", err)
+	}
+	return dcrutil.NewBlockFromBytes(blockBytes)
+}
+
+// ReadBootstrap reads all the blocks written by WriteBootstrap.
+func ReadBootstrap(r io.Reader, net *chaincfg.Params) ([]*dcrutil.Block, error) {
+	var blocks []*dcrutil.Block
+	for {
+		block, err := ReadBootstrapBlock(r, net)
+		if err == io.EOF {
+			return blocks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+}
+
+// ReadBootstrapFile reads all the blocks of the named file written by
+// WriteBootstrapFile.
+func ReadBootstrapFile(path string, net *chaincfg.Params) ([]*dcrutil.Block, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadBootstrap(bufio.NewReader(file), net)
+}
@@ -0,0 +1,490 @@
+package btcharness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jfixby/coinharness"
+	"github.com/jfixby/pin"
+	"github.com/picfight/pfcd/chaincfg"
+	"github.com/picfight/pfcd/chaincfg/chainhash"
+	"github.com/picfight/pfcd/dcrec/secp256k1"
+	"github.com/picfight/pfcd/dcrutil"
+	"github.com/picfight/pfcd/hdkeychain"
+	"github.com/picfight/pfcd/txscript"
+	"github.com/picfight/pfcd/wire"
+)
+
+// chainBuilderFeePerKB is the fee rate paid by the transactions spending the
+// coinbases of a fabricated chain.
+const chainBuilderFeePerKB = 1e4
+
+// ChainBuilderArgs bundles NewChainBuilder() arguments to minimize diff
+// in case a new argument for the function is added
+type ChainBuilderArgs struct {
+	Network      *chaincfg.Params
+	BlockVersion int32
+
+	// Seed is the HD seed the coinbase key is derived from the same way
+	// the InMemoryWallet derives it, so a wallet created with the same
+	// seed owns the funds of the fabricated chain
+	Seed coinharness.Seed
+
+	// BlockInterval is the time between two consecutive blocks,
+	// zero means the network TargetTimePerBlock
+	BlockInterval time.Duration
+
+	// SpendOutputs is the number of outputs every coinbase spend is split
+	// into, zero means a coinbase is only spent to fund tickets
+	SpendOutputs int
+
+	// Context bounds the time spent solving each block,
+	// nil means no limit
+	Context context.Context
+
+	// ExtraNonce provides the initial coinbase extranonces,
+	// nil means random ones
+	ExtraNonce ExtraNonceSource
+}
+
+// ChainBuilder fabricates a chain of valid blocks in memory without a running
+// node. Every block pays its coinbase to the key derived from the seed and
+// spends the oldest mature coinbase back to the same key.
+//
+// From the network stake enabled height the builder buys tickets paying to the
+// same key, keeping the ticket pool at the size targeted by the stake
+// difficulty algorithm, and from the stake validation height every block
+// includes the votes of all the tickets selected by the lottery. The stake
+// difficulty is calculated with CalcNextRequiredStakeDifficulty, thus only the
+// networks supported by it can be extended past the stake enabled height.
+type ChainBuilder struct {
+	net           *chaincfg.Params
+	blockVersion  int32
+	blockInterval time.Duration
+	spendOutputs  int
+	ctx           context.Context
+	extraNonce    ExtraNonceSource
+
+	coinbaseKey  *secp256k1.PrivateKey
+	coinbaseAddr dcrutil.Address
+	pkScript     []byte
+	keyRing      *KeyRing
+
+	blocks  []*dcrutil.Block
+	headers []*wire.BlockHeader
+
+	// matureQueue holds the coinbase outputs paying to the coinbase key
+	// in the order they mature
+	matureQueue []*chainOutput
+
+	// ticketFunds are the outputs set aside to purchase tickets
+	ticketFunds []*SpendableOutput
+
+	// tickets are the immature and live tickets of the chain
+	tickets map[chainhash.Hash]*chainTicket
+
+	// winners and finalState are the result of the ticket lottery of the
+	// tip
+	winners    []*chainhash.Hash
+	finalState [6]byte
+}
+
+// chainOutput is an output of a fabricated chain paying to the coinbase key.
+type chainOutput struct {
+	outPoint    wire.OutPoint
+	value       int64
+	blockHeight int64
+	blockIndex  uint32
+}
+
+// chainTicket is a ticket of a fabricated chain along with the height it
+// becomes live at.
+type chainTicket struct {
+	ticket     *Ticket
+	liveHeight int64
+}
+
+// NewChainBuilder creates a ChainBuilder starting from the genesis block of
+// args.Network.
+func NewChainBuilder(args *ChainBuilderArgs) (*ChainBuilder, error) {
+	pin.AssertNotNil("args.Network", args.Network)
+	pin.AssertNotNil("args.Seed", args.Seed)
+	pin.AssertTrue(fmt.Sprintf("Incorrect BlockVersion(%v)", args.BlockVersion),
+		args.BlockVersion > 0 || args.BlockVersion == CurrentBlockVersion)
+	net := args.Network
+
+	hdRoot, err := hdkeychain.NewMaster(args.Seed.([]byte), net)
+	if err != nil {
+		return nil, err
+	}
+	coinbaseChild, err := hdRoot.Child(0)
+	if err != nil {
+		return nil, err
+	}
+	coinbaseKey, err := coinbaseChild.ECPrivKey()
+	if err != nil {
+		return nil, err
+	}
+	coinbaseAddr, err := keyToAddr(coinbaseKey, net)
+	if err != nil {
+		return nil, err
+	}
+	pkScript, err := txscript.PayToAddrScript(coinbaseAddr)
+	if err != nil {
+		return nil, err
+	}
+	keyRing := NewKeyRing(net)
+	if _, err := keyRing.AddKey(coinbaseKey); err != nil {
+		return nil, err
+	}
+
+	blockInterval := args.BlockInterval
+	if blockInterval == 0 {
+		blockInterval = net.TargetTimePerBlock
+	}
+	genesis := dcrutil.NewBlock(net.GenesisBlock)
+	return &ChainBuilder{
+		net:           net,
+		blockVersion:  args.BlockVersion,
+		blockInterval: blockInterval,
+		spendOutputs:  args.SpendOutputs,
+		ctx:           args.Context,
+		extraNonce:    args.ExtraNonce,
+		coinbaseKey:   coinbaseKey,
+		coinbaseAddr:  coinbaseAddr,
+		pkScript:      pkScript,
+		keyRing:       keyRing,
+		blocks:        []*dcrutil.Block{genesis},
+		headers:       []*wire.BlockHeader{&net.GenesisBlock.Header},
+		tickets:       make(map[chainhash.Hash]*chainTicket),
+	}, nil
+}
+
+// CoinbaseAddress returns the address the fabricated chain pays to.
+func (b *ChainBuilder) CoinbaseAddress() dcrutil.Address {
+	return b.coinbaseAddr
+}
+
+// Tip returns the last block of the fabricated chain.
+func (b *ChainBuilder) Tip() *dcrutil.Block {
+	return b.blocks[len(b.blocks)-1]
+}
+
+// Blocks returns the fabricated blocks ordered by height, the genesis block
+// excluded.
+func (b *ChainBuilder) Blocks() []*dcrutil.Block {
+	return b.blocks[1:]
+}
+
+// Generate extends the chain with count blocks.
+func (b *ChainBuilder) Generate(count int) error {
+	for i := 0; i < count; i++ {
+		if _, err := b.NextBlock(nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NextBlock extends the chain with a block including the passed transactions
+// followed by the spend of the oldest mature coinbase, if any. The stake tree of
+// the block holds the votes of the lottery winners of the tip followed by the
+// ticket purchases.
+func (b *ChainBuilder) NextBlock(txns []*dcrutil.Tx) (*dcrutil.Block, error) {
+	prevBlock := b.Tip()
+	height := prevBlock.Height() + 1
+
+	sbitsHeaders := b.lastHeaders(StakeDifficultyHeadersCount(b.net))
+	sbits, err := CalcNextRequiredStakeDifficulty(sbitsHeaders, b.net)
+	if err != nil {
+		return nil, err
+	}
+	votes, err := b.createVotes(prevBlock)
+	if err != nil {
+		return nil, err
+	}
+	tickets, err := b.purchaseTickets(height, sbits, len(votes))
+	if err != nil {
+		return nil, err
+	}
+	stxns := append(votes, tickets...)
+
+	spendTx, funds, err := b.spendMatureCoinbase(height)
+	if err != nil {
+		return nil, err
+	}
+	if spendTx != nil {
+		txns = append(append([]*dcrutil.Tx{}, txns...), spendTx)
+	}
+
+	prevTime := prevBlock.MsgBlock().Header.Timestamp
+	block, err := CreateBlockWithArgs(prevBlock, &GenerateBlockArgs{
+		Txns:          txns,
+		BlockVersion:  b.blockVersion,
+		BlockTime:     prevTime.Add(b.blockInterval),
+		MiningAddress: b.coinbaseAddr,
+		Network:       b.net,
+		Context:       b.ctx,
+		ExtraNonce:    b.extraNonce,
+		PrevHeaders:   b.lastHeaders(DifficultyHeadersCount(b.net)),
+		STxns:         stxns,
+		StakeState: &StakeState{
+			VoteBits:   dcrutil.BlockValid,
+			FinalState: b.finalState,
+			PoolSize:   uint32(b.liveTickets(height - 1)),
+			SBits:      sbits,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b.blocks = append(b.blocks, block)
+	b.headers = append(b.headers, &block.MsgBlock().Header)
+	b.trackCoinbase(block)
+	b.trackTicketFunds(block, spendTx, funds)
+	if err := b.connectTickets(block); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// lastHeaders returns up to count last headers of the chain.
+func (b *ChainBuilder) lastHeaders(count int64) []*wire.BlockHeader {
+	headers := b.headers
+	if int64(len(headers)) > count {
+		headers = headers[int64(len(headers))-count:]
+	}
+	return headers
+}
+
+// liveTickets returns the number of tickets live at the passed height.
+func (b *ChainBuilder) liveTickets(height int64) int {
+	live := 0
+	for _, ticket := range b.tickets {
+		if ticket.liveHeight <= height {
+			live++
+		}
+	}
+	return live
+}
+
+// createVotes returns the votes approving the passed block of every ticket the
+// lottery selected to vote on it.
+func (b *ChainBuilder) createVotes(prevBlock *dcrutil.Block) ([]*dcrutil.Tx, error) {
+	votes := make([]*dcrutil.Tx, 0, len(b.winners))
+	for _, winner := range b.winners {
+		vote, err := NewVote(&VoteArgs{
+			Ticket:      b.tickets[*winner].ticket,
+			KeyRing:     b.keyRing,
+			BlockHash:   *prevBlock.Hash(),
+			BlockHeight: prevBlock.Height(),
+			VoteBits:    dcrutil.BlockValid,
+			Network:     b.net,
+		})
+		if err != nil {
+			return nil, err
+		}
+		votes = append(votes, dcrutil.NewTx(vote))
+	}
+	return votes, nil
+}
+
+// purchaseTickets returns the ticket purchases of the block at the passed
+// height, which fill the ticket pool up to the size targeted by the stake
+// difficulty algorithm. The tickets follow the passed number of votes in the
+// stake tree of the block.
+func (b *ChainBuilder) purchaseTickets(height int64, sbits int64, votes int) ([]*dcrutil.Tx, error) {
+	if height < b.net.StakeEnabledHeight {
+		return nil, nil
+	}
+	// The votes of the block spend their tickets.
+	target := int(b.net.TicketsPerBlock) *
+		(int(b.net.TicketPoolSize) + int(b.net.TicketMaturity))
+	count := target - len(b.tickets) + votes
+	if count > int(b.net.MaxFreshStakePerBlock) {
+		count = int(b.net.MaxFreshStakePerBlock)
+	}
+	if count > len(b.ticketFunds) {
+		count = len(b.ticketFunds)
+	}
+	if count <= 0 {
+		return nil, nil
+	}
+
+	tickets := make([]*dcrutil.Tx, 0, count)
+	for i := 0; i < count; i++ {
+		tx, err := NewTicketPurchase(&TicketPurchaseArgs{
+			Inputs:        b.ticketFunds[i : i+1],
+			KeyRing:       b.keyRing,
+			TicketPrice:   sbits,
+			VotingAddress: b.coinbaseAddr,
+			RewardAddress: b.coinbaseAddr,
+			ChangeAddress: b.coinbaseAddr,
+			FeePerKB:      chainBuilderFeePerKB,
+			Network:       b.net,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to purchase a ticket at "+
+				"height %v: %v", height, err)
+		}
+		tickets = append(tickets, dcrutil.NewTx(tx))
+		b.tickets[tx.TxHash()] = &chainTicket{
+			ticket: &Ticket{
+				Tx:          tx,
+				BlockHeight: uint32(height),
+				BlockIndex:  uint32(votes + i),
+			},
+			liveHeight: height + int64(b.net.TicketMaturity),
+		}
+	}
+	b.ticketFunds = b.ticketFunds[count:]
+	return tickets, nil
+}
+
+// connectTickets updates the ticket pool with the passed block the way the
+// node does and draws the ticket lottery of the block.
+func (b *ChainBuilder) connectTickets(block *dcrutil.Block) error {
+	height := block.Height()
+	if height < b.net.StakeEnabledHeight {
+		return nil
+	}
+	// The winners of the previous block either voted or missed, expired
+	// tickets are removed along with them.
+	for _, winner := range b.winners {
+		delete(b.tickets, *winner)
+	}
+	expiry := int64(b.net.TicketExpiry)
+	live := make([]*chainhash.Hash, 0, len(b.tickets))
+	for hash, ticket := range b.tickets {
+		if height > expiry && ticket.liveHeight <= height-expiry {
+			delete(b.tickets, hash)
+			continue
+		}
+		if ticket.liveHeight <= height {
+			hash := hash
+			live = append(live, &hash)
+		}
+	}
+
+	winners, finalState, err := CalcTicketLottery(&block.MsgBlock().Header,
+		live, b.net)
+	if err != nil {
+		return err
+	}
+	b.winners = winners
+	b.finalState = finalState
+	return nil
+}
+
+// trackCoinbase queues the coinbase outputs of the passed block paying to the
+// coinbase key.
+func (b *ChainBuilder) trackCoinbase(block *dcrutil.Block) {
+	coinbaseTx := block.Transactions()[0]
+	for i, txOut := range coinbaseTx.MsgTx().TxOut {
+		if txOut.Value == 0 || string(txOut.PkScript) != string(b.pkScript) {
+			continue
+		}
+		b.matureQueue = append(b.matureQueue, &chainOutput{
+			outPoint: *wire.NewOutPoint(coinbaseTx.Hash(), uint32(i),
+				wire.TxTreeRegular),
+			value:       txOut.Value,
+			blockHeight: block.Height(),
+			blockIndex:  0,
+		})
+	}
+}
+
+// trackTicketFunds sets aside the passed number of last outputs of the coinbase
+// spend included into the passed block to purchase tickets.
+func (b *ChainBuilder) trackTicketFunds(block *dcrutil.Block, spendTx *dcrutil.Tx, funds int) {
+	if spendTx == nil {
+		return
+	}
+	// The coinbase spend is the last transaction of the regular tree.
+	blockIndex := uint32(len(block.Transactions()) - 1)
+	txOuts := spendTx.MsgTx().TxOut
+	for i := len(txOuts) - funds; i < len(txOuts); i++ {
+		b.ticketFunds = append(b.ticketFunds, &SpendableOutput{
+			OutPoint: *wire.NewOutPoint(spendTx.Hash(), uint32(i),
+				wire.TxTreeRegular),
+			Value:       txOuts[i].Value,
+			PkScript:    txOuts[i].PkScript,
+			BlockHeight: uint32(block.Height()),
+			BlockIndex:  blockIndex,
+		})
+	}
+}
+
+// spendMatureCoinbase returns a transaction splitting the oldest coinbase
+// output which is mature at the passed height into the configured number of
+// outputs followed by the outputs funding the ticket purchases of the next
+// block, whose number is returned along with the transaction. Nil is returned
+// when there is nothing to spend.
+func (b *ChainBuilder) spendMatureCoinbase(height int64) (*dcrutil.Tx, int, error) {
+	funds := 0
+	if height+1 >= b.net.StakeEnabledHeight {
+		funds = int(b.net.MaxFreshStakePerBlock) - len(b.ticketFunds)
+		if funds < 0 {
+			funds = 0
+		}
+	}
+	outputs := b.spendOutputs + funds
+	if outputs <= 0 || len(b.matureQueue) == 0 {
+		return nil, 0, nil
+	}
+	prevOut := b.matureQueue[0]
+	if height-prevOut.blockHeight < int64(b.net.CoinbaseMaturity) {
+		return nil, 0, nil
+	}
+	b.matureQueue = b.matureQueue[1:]
+
+	tx := wire.NewMsgTx()
+	tx.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: prevOut.outPoint,
+		Sequence:         wire.MaxTxInSequenceNum,
+		ValueIn:          prevOut.value,
+		BlockHeight:      uint32(prevOut.blockHeight),
+		BlockIndex:       prevOut.blockIndex,
+	})
+	for i := 0; i < outputs; i++ {
+		tx.AddTxOut(wire.NewTxOut(0, b.pkScript))
+	}
+
+	// Estimate the size of the signed transaction to pay the fee.
+	const sigScriptSize = 1 + 73 + 1 + 33
+	size := tx.SerializeSize() + sigScriptSize
+	fee := int64(size) * chainBuilderFeePerKB / 1000
+	amount := (prevOut.value - fee) / int64(outputs)
+	if amount <= 0 {
+		return nil, 0, errors.New("coinbase output is too small to be split")
+	}
+	for _, txOut := range tx.TxOut {
+		txOut.Value = amount
+	}
+	// Pay the remainder of the division to the first output.
+	tx.TxOut[0].Value += prevOut.value - fee - amount*int64(outputs)
+
+	sigScript, err := txscript.SignatureScript(tx, 0, b.pkScript,
+		txscript.SigHashAll, b.coinbaseKey, true)
+	if err != nil {
+		return nil, 0, err
+	}
+	tx.TxIn[0].SignatureScript = sigScript
+	return dcrutil.NewTx(tx), funds, nil
+}
+
+// WriteBootstrap writes the fabricated blocks to the passed writer with
+// WriteBootstrap.
+func (b *ChainBuilder) WriteBootstrap(w io.Writer) error {
+	return WriteBootstrap(w, b.Blocks(), b.net)
+}
+
+// WriteBootstrapFile writes the fabricated blocks to the named file with
+// WriteBootstrapFile.
+func (b *ChainBuilder) WriteBootstrapFile(path string) error {
+	return WriteBootstrapFile(path, b.Blocks(), b.net)
+}
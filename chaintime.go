@@ -0,0 +1,124 @@
+package btcharness
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jfixby/coinharness"
+	"github.com/picfight/pfcd/blockchain"
+	"github.com/picfight/pfcd/dcrutil"
+	"github.com/picfight/pfcd/rpcclient"
+)
+
+// TimestampLimits is the range of timestamps the node accepts for a new block
+// on top of its best block
+type TimestampLimits struct {
+	// MedianTime is the median time past of the best block
+	MedianTime time.Time
+
+	// Min is the earliest acceptable timestamp, one second after the
+	// MedianTime
+	Min time.Time
+
+	// Max is the latest acceptable timestamp according to the harness
+	// clock, which is assumed to match the node's adjusted time
+	Max time.Time
+}
+
+// FetchTimestampLimits calculates the TimestampLimits for a new block on top
+// of the node's best block. Timestamps one second below Min or above Max break
+// the consensus rules.
+func FetchTimestampLimits(client coinharness.RPCClient) (*TimestampLimits, error) {
+	medianTime, err := FetchMedianTime(client)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Unix(time.Now().Unix(), 0)
+	return &TimestampLimits{
+		MedianTime: medianTime,
+		Min:        medianTime.Add(time.Second),
+		Max:        now.Add(blockchain.MaxTimeOffsetSeconds * time.Second),
+	}, nil
+}
+
+// FetchMedianTime fetches the headers of the last MedianTimeBlocks blocks from
+// the node and returns the median time past of the node's best block.
+func FetchMedianTime(client coinharness.RPCClient) (time.Time, error) {
+	rpc := client.Internal().(*rpcclient.Client)
+
+	tipHash, _, err := rpc.GetBestBlock()
+	if err != nil {
+		return time.Time{}, err
+	}
+	headers, err := FetchHeaders(client, tipHash, MedianTimeBlocks)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return CalcPastMedianTime(headers)
+}
+
+// AdvanceMedianTime mines and submits the smallest number of blocks which
+// moves the median time past of the node's best block to the target time or
+// later. Every block is built from a copy of args with the timestamp set to
+// the target unless the median time requires a later one. The target must not
+// be above the Max of TimestampLimits.
+func AdvanceMedianTime(client coinharness.RPCClient, target time.Time, args *GenerateBlockArgs) ([]*dcrutil.Block, error) {
+	var blocks []*dcrutil.Block
+	for {
+		limits, err := FetchTimestampLimits(client)
+		if err != nil {
+			return blocks, err
+		}
+		if !limits.MedianTime.Before(target) {
+			return blocks, nil
+		}
+		if target.After(limits.Max) {
+			return blocks, fmt.Errorf("target time %v is beyond the "+
+				"latest acceptable block timestamp %v", target,
+				limits.Max)
+		}
+
+		blockArgs := *args
+		blockArgs.BlockTime = target
+		if blockArgs.BlockTime.Before(limits.Min) {
+			blockArgs.BlockTime = limits.Min
+		}
+		block, err := GenerateAndSubmitBlockWithCustomCoinbaseOutputs(
+			client, &blockArgs)
+		if err != nil {
+			return blocks, err
+		}
+		blocks = append(blocks, block)
+	}
+}
+
+// GenerateBlocksAtInterval mines and submits count blocks, each built from a
+// copy of args with a timestamp interval after the timestamp of the previous
+// block.
+func GenerateBlocksAtInterval(client coinharness.RPCClient, count int, interval time.Duration, args *GenerateBlockArgs) ([]*dcrutil.Block, error) {
+	rpc := client.Internal().(*rpcclient.Client)
+
+	tipHash, _, err := rpc.GetBestBlock()
+	if err != nil {
+		return nil, err
+	}
+	tip, err := rpc.GetBlockHeader(tipHash)
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks []*dcrutil.Block
+	blockTime := tip.Timestamp
+	for i := 0; i < count; i++ {
+		blockTime = blockTime.Add(interval)
+		blockArgs := *args
+		blockArgs.BlockTime = blockTime
+		block, err := GenerateAndSubmitBlockWithCustomCoinbaseOutputs(
+			client, &blockArgs)
+		if err != nil {
+			return blocks, err
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
@@ -0,0 +1,213 @@
+package btcharness
+
+import (
+	"fmt"
+
+	"github.com/picfight/pfcd/blockchain"
+	"github.com/picfight/pfcd/chaincfg"
+	"github.com/picfight/pfcd/dcrutil"
+	"github.com/picfight/pfcd/txscript"
+	"github.com/picfight/pfcd/wire"
+)
+
+// DefaultMinRelayTxFee is the minimum relay fee rate in atoms per kilobyte the
+// node applies by default. It defines which outputs are considered dust.
+const DefaultMinRelayTxFee = dcrutil.Amount(1e4)
+
+// CoinbaseViolation identifies a mistake in custom coinbase outputs detected
+// by ValidateCoinbaseOutputs.
+type CoinbaseViolation int
+
+const (
+	// CoinbaseOverpays means the outputs pay more than the work subsidy
+	// plus the fees of the block.
+	CoinbaseOverpays CoinbaseViolation = iota
+
+	// CoinbaseNegativeValue means an output has a negative value.
+	CoinbaseNegativeValue
+
+	// CoinbaseEmptyScript means an output has no public key script.
+	CoinbaseEmptyScript
+
+	// CoinbaseUnspendableValue means an output locks a value with a
+	// provably unspendable script.
+	CoinbaseUnspendableValue
+
+	// CoinbaseNonStandardScript means an output has a non-standard public
+	// key script. Consensus allows it, so it is only reported unless the
+	// CoinbasePolicy allows non-standard scripts.
+	CoinbaseNonStandardScript
+
+	// CoinbaseDustOutput means an output is considered dust by the node
+	// relay policy.
+	CoinbaseDustOutput
+)
+
+var coinbaseViolationStrings = map[CoinbaseViolation]string{
+	CoinbaseOverpays:          "CoinbaseOverpays",
+	CoinbaseNegativeValue:     "CoinbaseNegativeValue",
+	CoinbaseEmptyScript:       "CoinbaseEmptyScript",
+	CoinbaseUnspendableValue:  "CoinbaseUnspendableValue",
+	CoinbaseNonStandardScript: "CoinbaseNonStandardScript",
+	CoinbaseDustOutput:        "CoinbaseDustOutput",
+}
+
+// String returns the CoinbaseViolation as a human-readable name.
+func (v CoinbaseViolation) String() string {
+	if s := coinbaseViolationStrings[v]; s != "" {
+		return s
+	}
+	return fmt.Sprintf("Unknown CoinbaseViolation (%d)", int(v))
+}
+
+// CoinbaseOutputError describes custom coinbase outputs which would make the
+// node reject the block or treat its outputs as non-standard.
+type CoinbaseOutputError struct {
+	Violation CoinbaseViolation
+
+	// Index is the index of the offending output in MineTo,
+	// -1 when the outputs are wrong as a whole
+	Index int
+
+	Height int64
+
+	// Value is the value of the offending output or the total value of the
+	// outputs
+	Value int64
+
+	// Limit is the allowed total value for CoinbaseOverpays or the dust
+	// threshold for CoinbaseDustOutput
+	Limit int64
+}
+
+// Error satisfies the error interface and prints human-readable errors.
+func (e *CoinbaseOutputError) Error() string {
+	switch e.Violation {
+	case CoinbaseOverpays:
+		return fmt.Sprintf("%v: coinbase outputs of block %v pay %v "+
+			"which is more than the allowed %v", e.Violation,
+			e.Height, e.Value, e.Limit)
+	case CoinbaseDustOutput:
+		return fmt.Sprintf("%v: coinbase output %v of block %v pays %v "+
+			"which is below the dust threshold of %v", e.Violation,
+			e.Index, e.Height, e.Value, e.Limit)
+	}
+	return fmt.Sprintf("%v: coinbase output %v of block %v paying %v",
+		e.Violation, e.Index, e.Height, e.Value)
+}
+
+// CoinbasePolicy selects the checks ValidateCoinbaseOutputs applies on top of
+// the consensus rules
+type CoinbasePolicy struct {
+	// AllowNonStandard accepts outputs with non-standard public key
+	// scripts
+	AllowNonStandard bool
+}
+
+// CalcCoinbaseSubsidy returns the work subsidy and the tax the coinbase of the
+// block at the passed height with the passed number of votes pays.
+func CalcCoinbaseSubsidy(height int64, voters uint16, net *chaincfg.Params) (work int64, tax int64) {
+	subsidyCache := blockchain.NewSubsidyCache(0, net)
+	work = blockchain.CalcBlockWorkSubsidy(subsidyCache, height, voters, net)
+	tax = blockchain.CalcBlockTaxSubsidy(subsidyCache, height, voters, net)
+	return work, tax
+}
+
+// ValidateCoinbaseOutputs checks the outputs paying the work subsidy of the
+// block at the passed height along with the fees of its regular and stake
+// transactions. A nil policy rejects non-standard scripts. A
+// *CoinbaseOutputError is returned for the first mistake found.
+func ValidateCoinbaseOutputs(mineTo []wire.TxOut, height int64, voters uint16, fees int64, policy *CoinbasePolicy, net *chaincfg.Params) error {
+	if policy == nil {
+		policy = &CoinbasePolicy{}
+	}
+	// Fees are penalized for missing votes the same way the subsidy is,
+	// as done by the connect checks of the node.
+	if height >= net.StakeValidationHeight {
+		fees = fees * int64(voters) / int64(net.TicketsPerBlock)
+	}
+	work, _ := CalcCoinbaseSubsidy(height, voters, net)
+
+	total := int64(0)
+	for i := range mineTo {
+		txOut := &mineTo[i]
+		outputError := &CoinbaseOutputError{
+			Index:  i,
+			Height: height,
+			Value:  txOut.Value,
+		}
+		switch {
+		case txOut.Value < 0:
+			outputError.Violation = CoinbaseNegativeValue
+			return outputError
+		case len(txOut.PkScript) == 0:
+			outputError.Violation = CoinbaseEmptyScript
+			return outputError
+		case txOut.Value > 0 &&
+			txscript.IsUnspendable(txOut.Value, txOut.PkScript):
+			outputError.Violation = CoinbaseUnspendableValue
+			return outputError
+		}
+		class := txscript.GetScriptClass(txOut.Version, txOut.PkScript)
+		if class == txscript.NonStandardTy && !policy.AllowNonStandard {
+			outputError.Violation = CoinbaseNonStandardScript
+			return outputError
+		}
+		if class != txscript.NullDataTy {
+			threshold := DustThreshold(txOut, DefaultMinRelayTxFee)
+			if txOut.Value < threshold {
+				outputError.Violation = CoinbaseDustOutput
+				outputError.Limit = threshold
+				return outputError
+			}
+		}
+		total += txOut.Value
+	}
+
+	if total > work+fees {
+		return &CoinbaseOutputError{
+			Violation: CoinbaseOverpays,
+			Index:     -1,
+			Height:    height,
+			Value:     total,
+			Limit:     work + fees,
+		}
+	}
+	return nil
+}
+
+// DustThreshold returns the smallest value of the passed output the node relay
+// policy doesn't consider dust for the passed minimum relay fee rate. The cost
+// of spending an output is estimated with the size of a typical
+// pay-to-pubkey-hash input.
+func DustThreshold(txOut *wire.TxOut, minRelayTxFee dcrutil.Amount) int64 {
+	// An output is dust when the cost to the network to spend it is more
+	// than 1/3 of the minimum relay fee: value*1000/(3*size) < minFee.
+	const redeemInputSize = 165
+	totalSize := int64(txOut.SerializeSize() + redeemInputSize)
+	threshold := 3 * totalSize * int64(minRelayTxFee)
+	// Round up the division by 1000.
+	return (threshold + 999) / 1000
+}
+
+// txnsFees returns the total fees paid by the passed transactions according to
+// the input values they commit to. Inputs without a committed value are
+// rejected, since their fees can't be told, see FillFraudProofs().
+func txnsFees(txns []*dcrutil.Tx) (int64, error) {
+	fees := int64(0)
+	for _, tx := range txns {
+		for i, txIn := range tx.MsgTx().TxIn {
+			if txIn.ValueIn <= 0 {
+				return 0, fmt.Errorf("input %v of transaction %v "+
+					"commits to the value %v, the fee of the "+
+					"transaction is unknown", i, tx.Hash(),
+					txIn.ValueIn)
+			}
+			fees += txIn.ValueIn
+		}
+		for _, txOut := range tx.MsgTx().TxOut {
+			fees -= txOut.Value
+		}
+	}
+	return fees, nil
+}
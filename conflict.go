@@ -0,0 +1,310 @@
+package btcharness
+
+import (
+	"fmt"
+
+	"github.com/jfixby/coinharness"
+	"github.com/jfixby/pin"
+	"github.com/picfight/pfcd/chaincfg"
+	"github.com/picfight/pfcd/chaincfg/chainhash"
+	"github.com/picfight/pfcd/dcrutil"
+	"github.com/picfight/pfcd/rpcclient"
+	"github.com/picfight/pfcd/txscript"
+	"github.com/picfight/pfcd/wire"
+)
+
+// ConflictKind selects the scenario produced by GenerateConflict()
+type ConflictKind int
+
+const (
+	// MempoolConflict sends both transactions to the first node, the
+	// second one is expected to be rejected as a double spend
+	MempoolConflict ConflictKind = iota
+
+	// MinedOverMempoolConflict sends the second transaction to the
+	// mempool of the first node and then mines the first one in a block,
+	// which is expected to evict the second one from the mempool
+	MinedOverMempoolConflict
+
+	// MempoolOverMinedConflict mines the first transaction in a block and
+	// then sends the second one to the first node, which is expected to
+	// reject it as spending a spent output
+	MempoolOverMinedConflict
+
+	// NodesConflict sends the first transaction to the first node and the
+	// second one to the second node. Which transaction each node keeps
+	// depends on the order the transactions reach it, so connected nodes
+	// race while disconnected nodes keep their own transaction until they
+	// are connected.
+	NodesConflict
+)
+
+// String returns the name of the scenario.
+func (k ConflictKind) String() string {
+	switch k {
+	case MempoolConflict:
+		return "MempoolConflict"
+	case MinedOverMempoolConflict:
+		return "MinedOverMempoolConflict"
+	case MempoolOverMinedConflict:
+		return "MempoolOverMinedConflict"
+	case NodesConflict:
+		return "NodesConflict"
+	}
+	return fmt.Sprintf("ConflictKind(%d)", int(k))
+}
+
+// ConflictArgs bundles GenerateConflict() arguments to minimize diff
+// in case a new argument for the function is added
+type ConflictArgs struct {
+	Kind ConflictKind
+
+	// Clients are the nodes the conflict is reported for, the first one
+	// receives the first transaction and mines the block of the mined
+	// scenarios. NodesConflict requires at least two clients.
+	Clients []coinharness.RPCClient
+
+	// Output is spent by both transactions, it has to be confirmed in
+	// the mined scenarios
+	Output  *SpendableOutput
+	KeyRing *KeyRing
+
+	// PayTo receives the value of the output less the fee, the first
+	// transaction pays Fee and the second one twice Fee so the
+	// transactions differ
+	PayTo dcrutil.Address
+	Fee   int64
+
+	// Block describes the block mining the first transaction in the
+	// mined scenarios, its Txns are replaced,
+	// nil means a block of CurrentBlockVersion
+	Block *GenerateBlockArgs
+
+	Network *chaincfg.Params
+}
+
+// ConflictNode reports which of the conflicting transactions a node kept
+type ConflictNode struct {
+	// Kept is the hash of the transaction found in the mempool or in the
+	// best chain of the node, nil when the node has neither of them
+	Kept *chainhash.Hash
+
+	// Mined is true when the kept transaction is in the best chain
+	Mined bool
+}
+
+// ConflictResult reports the outcome of GenerateConflict()
+type ConflictResult struct {
+	First      *wire.MsgTx
+	FirstHash  *chainhash.Hash
+	Second     *wire.MsgTx
+	SecondHash *chainhash.Hash
+
+	// FirstErr and SecondErr are the errors the nodes returned when the
+	// transactions were sent, nil when the transaction was accepted or
+	// not sent but mined
+	FirstErr  error
+	SecondErr error
+
+	// Block mines the first transaction in the mined scenarios
+	Block *dcrutil.Block
+
+	// Nodes reports the transaction kept by each of the clients, in the
+	// order of ConflictArgs.Clients
+	Nodes []*ConflictNode
+}
+
+// GenerateConflict builds two transactions spending the same output, delivers
+// them to the nodes as described by args.Kind and reports which transaction
+// each node kept. Rejections of the transactions are reported in the result
+// and are not errors.
+func GenerateConflict(args *ConflictArgs) (*ConflictResult, error) {
+	pin.AssertTrue("args.Clients is empty", len(args.Clients) > 0)
+	pin.AssertTrue("NodesConflict requires two clients",
+		args.Kind != NodesConflict || len(args.Clients) > 1)
+	pin.AssertNotNil("args.Output", args.Output)
+	pin.AssertNotNil("args.KeyRing", args.KeyRing)
+
+	first, err := conflictTx(args, args.Fee)
+	if err != nil {
+		return nil, err
+	}
+	second, err := conflictTx(args, 2*args.Fee)
+	if err != nil {
+		return nil, err
+	}
+	firstHash := first.TxHash()
+	secondHash := second.TxHash()
+	result := &ConflictResult{
+		First:      first,
+		FirstHash:  &firstHash,
+		Second:     second,
+		SecondHash: &secondHash,
+	}
+
+	client := args.Clients[0]
+	switch args.Kind {
+	case MempoolConflict:
+		_, result.FirstErr = client.SendRawTransaction(
+			TransactionRawToTx(first), true)
+		_, result.SecondErr = client.SendRawTransaction(
+			TransactionRawToTx(second), true)
+
+	case MinedOverMempoolConflict:
+		_, result.SecondErr = client.SendRawTransaction(
+			TransactionRawToTx(second), true)
+		result.Block, err = mineConflictTx(client, first, args)
+		if err != nil {
+			return result, err
+		}
+
+	case MempoolOverMinedConflict:
+		result.Block, err = mineConflictTx(client, first, args)
+		if err != nil {
+			return result, err
+		}
+		_, result.SecondErr = client.SendRawTransaction(
+			TransactionRawToTx(second), true)
+
+	case NodesConflict:
+		_, result.FirstErr = client.SendRawTransaction(
+			TransactionRawToTx(first), true)
+		_, result.SecondErr = args.Clients[1].SendRawTransaction(
+			TransactionRawToTx(second), true)
+
+	default:
+		return nil, fmt.Errorf("unknown conflict kind %v", args.Kind)
+	}
+
+	result.Nodes, err = CheckConflict(args.Clients, result)
+	if err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// CheckConflict reports which of the conflicting transactions of the passed
+// result each of the clients kept, it can be called again once the nodes have
+// exchanged the transactions or blocks.
+func CheckConflict(clients []coinharness.RPCClient, result *ConflictResult) ([]*ConflictNode, error) {
+	nodes := make([]*ConflictNode, len(clients))
+	for i, client := range clients {
+		rpc := client.Internal().(*rpcclient.Client)
+		node := &ConflictNode{}
+		for _, hash := range []*chainhash.Hash{result.FirstHash,
+			result.SecondHash} {
+			// The outputs of the conflicting transactions are not
+			// spent, so the node knows the transaction when it
+			// knows its first output.
+			txOut, err := rpc.GetTxOut(hash, 0, true)
+			if err != nil {
+				return nil, err
+			}
+			if txOut != nil {
+				node.Kept = hash
+				node.Mined = txOut.Confirmations > 0
+				break
+			}
+		}
+		nodes[i] = node
+	}
+	return nodes, nil
+}
+
+// conflictTx returns the transaction spending the conflicting output to the
+// PayTo address less the passed fee.
+func conflictTx(args *ConflictArgs, fee int64) (*wire.MsgTx, error) {
+	pkScript, err := txscript.PayToAddrScript(args.PayTo)
+	if err != nil {
+		return nil, err
+	}
+	value := args.Output.Value - fee
+	if value <= 0 {
+		return nil, fmt.Errorf("output value %v does not cover the fee %v",
+			dcrutil.Amount(args.Output.Value), dcrutil.Amount(fee))
+	}
+	return SpendOutputs(args.KeyRing, []*SpendableOutput{args.Output},
+		[]*wire.TxOut{wire.NewTxOut(value, pkScript)})
+}
+
+// mineConflictTx mines the passed transaction in a block on top of the best
+// block of the node.
+func mineConflictTx(client coinharness.RPCClient, tx *wire.MsgTx, args *ConflictArgs) (*dcrutil.Block, error) {
+	// The transaction is not in the mempool, so the fraud proofs the node
+	// fills in for mempool transactions have to be supplied.
+	mined := tx.Copy()
+	if err := FillFraudProofs(client, mined); err != nil {
+		return nil, err
+	}
+
+	blockArgs := GenerateBlockArgs{
+		BlockVersion: CurrentBlockVersion,
+		Network:      args.Network,
+	}
+	if args.Block != nil {
+		blockArgs = *args.Block
+	}
+	blockArgs.Txns = []*dcrutil.Tx{dcrutil.NewTx(mined)}
+	return GenerateAndSubmitBlock(client, &blockArgs)
+}
+
+// FillFraudProofs sets the value, block height and block index of the outputs
+// spent by the inputs of the transaction as reported by the node. The outputs
+// have to be unspent in the best chain of the node. The fraud proofs are not
+// signed, so signed transactions remain valid.
+func FillFraudProofs(client coinharness.RPCClient, tx *wire.MsgTx) error {
+	rpc := client.Internal().(*rpcclient.Client)
+
+	_, bestHeight, err := rpc.GetBestBlock()
+	if err != nil {
+		return err
+	}
+	for i, txIn := range tx.TxIn {
+		outPoint := &txIn.PreviousOutPoint
+		txOut, err := rpc.GetTxOut(&outPoint.Hash, outPoint.Index, false)
+		if err != nil {
+			return err
+		}
+		if txOut == nil || txOut.Confirmations <= 0 {
+			return fmt.Errorf("input %v spends %v which is not an "+
+				"unspent output of the best chain", i, outPoint)
+		}
+		value, err := dcrutil.NewAmount(txOut.Value)
+		if err != nil {
+			return err
+		}
+		height := bestHeight - txOut.Confirmations + 1
+		index, err := blockTxIndex(rpc, height, outPoint)
+		if err != nil {
+			return err
+		}
+		txIn.ValueIn = int64(value)
+		txIn.BlockHeight = uint32(height)
+		txIn.BlockIndex = index
+	}
+	return nil
+}
+
+// blockTxIndex returns the index of the transaction of the passed outpoint in
+// its tree of the block at the passed height.
+func blockTxIndex(rpc *rpcclient.Client, height int64, outPoint *wire.OutPoint) (uint32, error) {
+	hash, err := rpc.GetBlockHash(height)
+	if err != nil {
+		return 0, err
+	}
+	mBlock, err := rpc.GetBlock(hash)
+	if err != nil {
+		return 0, err
+	}
+	txns := mBlock.Transactions
+	if outPoint.Tree == wire.TxTreeStake {
+		txns = mBlock.STransactions
+	}
+	for i, tx := range txns {
+		if tx.TxHash() == outPoint.Hash {
+			return uint32(i), nil
+		}
+	}
+	return 0, fmt.Errorf("transaction %v is not in block %v at height %v",
+		outPoint.Hash, hash, height)
+}
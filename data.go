@@ -2,11 +2,18 @@ package btcharness
 
 import (
 	"crypto/ecdsa"
+	"encoding/hex"
+	"time"
+
+	"github.com/jfixby/coin"
 	"github.com/jfixby/coinharness"
 	"github.com/picfight/pfcd/chaincfg"
+	"github.com/picfight/pfcd/chaincfg/chainhash"
 	"github.com/picfight/pfcd/dcrec/secp256k1"
+	"github.com/picfight/pfcd/dcrjson"
 	"github.com/picfight/pfcd/dcrutil"
 	"github.com/picfight/pfcd/hdkeychain"
+	"github.com/picfight/pfcd/txscript"
 	"github.com/picfight/pfcd/wire"
 )
 
@@ -38,6 +45,142 @@ func (h *BlockHeader) Height() int64 {
 	return int64(h.legacy.Height)
 }
 
+func (h *BlockHeader) BlockHash() chainhash.Hash {
+	return h.legacy.BlockHash()
+}
+
+func (h *BlockHeader) Version() int32 {
+	return h.legacy.Version
+}
+
+func (h *BlockHeader) PrevBlock() chainhash.Hash {
+	return h.legacy.PrevBlock
+}
+
+func (h *BlockHeader) MerkleRoot() chainhash.Hash {
+	return h.legacy.MerkleRoot
+}
+
+func (h *BlockHeader) StakeRoot() chainhash.Hash {
+	return h.legacy.StakeRoot
+}
+
+func (h *BlockHeader) VoteBits() uint16 {
+	return h.legacy.VoteBits
+}
+
+func (h *BlockHeader) FinalState() [6]byte {
+	return h.legacy.FinalState
+}
+
+func (h *BlockHeader) Voters() uint16 {
+	return h.legacy.Voters
+}
+
+func (h *BlockHeader) FreshStake() uint8 {
+	return h.legacy.FreshStake
+}
+
+func (h *BlockHeader) Revocations() uint8 {
+	return h.legacy.Revocations
+}
+
+func (h *BlockHeader) PoolSize() uint32 {
+	return h.legacy.PoolSize
+}
+
+func (h *BlockHeader) Bits() uint32 {
+	return h.legacy.Bits
+}
+
+func (h *BlockHeader) SBits() int64 {
+	return h.legacy.SBits
+}
+
+func (h *BlockHeader) Size() uint32 {
+	return h.legacy.Size
+}
+
+func (h *BlockHeader) Timestamp() time.Time {
+	return h.legacy.Timestamp
+}
+
+func (h *BlockHeader) Nonce() uint32 {
+	return h.legacy.Nonce
+}
+
+func (h *BlockHeader) ExtraData() [32]byte {
+	return h.legacy.ExtraData
+}
+
+func (h *BlockHeader) StakeVersion() uint32 {
+	return h.legacy.StakeVersion
+}
+
+// MsgBlock is a complete block, unlike coinharness.MsgBlock it holds the header
+// and the stake tree
+type MsgBlock struct {
+	Header        *BlockHeader
+	Transactions  []*coinharness.MessageTx
+	STransactions []*coinharness.MessageTx
+}
+
+func (b *MsgBlock) BlockHash() chainhash.Hash {
+	return b.Header.BlockHash()
+}
+
+// BlockVerbose is a MsgBlock along with the chain state the node reports for
+// it
+type BlockVerbose struct {
+	Block *MsgBlock
+
+	// Confirmations is the number of blocks on top of the block plus one,
+	// or -1 when the block is not in the main chain
+	Confirmations int64
+
+	// NextHash is the hash of the next main chain block, nil for the best
+	// block and for side chain blocks
+	NextHash *chainhash.Hash
+
+	// Size of the serialized block
+	Size int32
+
+	Difficulty float64
+	ChainWork  string
+}
+
+// MempoolTxType filters the mempool transactions by type
+type MempoolTxType string
+
+const (
+	MempoolAll         = MempoolTxType(dcrjson.GRMAll)
+	MempoolRegular     = MempoolTxType(dcrjson.GRMRegular)
+	MempoolTickets     = MempoolTxType(dcrjson.GRMTickets)
+	MempoolVotes       = MempoolTxType(dcrjson.GRMVotes)
+	MempoolRevocations = MempoolTxType(dcrjson.GRMRevocations)
+)
+
+// MempoolEntry is a mempool transaction along with the state the node keeps
+// for it
+type MempoolEntry struct {
+	// Size of the serialized transaction
+	Size int32
+
+	Fee coin.Amount
+
+	// Time the transaction entered the mempool
+	Time time.Time
+
+	// Height of the best block when the transaction entered the mempool
+	Height int64
+
+	StartingPriority float64
+	CurrentPriority  float64
+
+	// Depends are the mempool transactions the transaction spends from
+	Depends []*chainhash.Hash
+}
+
 type PrivateKey struct {
 	legacy *secp256k1.PrivateKey
 }
@@ -50,6 +193,132 @@ type PublicKey struct {
 	legacy ecdsa.PublicKey
 }
 
+// ParsePublicKey parses a compressed or uncompressed secp256k1 public key.
+func ParsePublicKey(serialized []byte) (*PublicKey, error) {
+	pubKey, err := secp256k1.ParsePubKey(serialized)
+	if err != nil {
+		return nil, err
+	}
+	return &PublicKey{legacy: ecdsa.PublicKey(*pubKey)}, nil
+}
+
+// ParsePublicKeyHex parses the hex encoding of a compressed or uncompressed
+// secp256k1 public key.
+func ParsePublicKeyHex(serialized string) (*PublicKey, error) {
+	b, err := hex.DecodeString(serialized)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePublicKey(b)
+}
+
+func (k PublicKey) pubKey() *secp256k1.PublicKey {
+	return (*secp256k1.PublicKey)(&k.legacy)
+}
+
+// SerializeCompressed returns the 33-byte compressed serialization of the key.
+func (k PublicKey) SerializeCompressed() []byte {
+	return k.pubKey().SerializeCompressed()
+}
+
+// SerializeUncompressed returns the 65-byte uncompressed serialization of the
+// key.
+func (k PublicKey) SerializeUncompressed() []byte {
+	return k.pubKey().SerializeUncompressed()
+}
+
+// String returns the hex encoding of the compressed serialization of the key.
+func (k PublicKey) String() string {
+	return hex.EncodeToString(k.SerializeCompressed())
+}
+
+// IsEqual returns whether the passed key is the same key.
+func (k PublicKey) IsEqual(other *PublicKey) bool {
+	return k.pubKey().IsEqual(other.pubKey())
+}
+
+// Hash160 returns the RIPEMD160(BLAKE256) hash of the compressed serialization
+// of the key, the hash paid to by pay-to-pubkey-hash outputs.
+func (k PublicKey) Hash160() []byte {
+	return dcrutil.Hash160(k.SerializeCompressed())
+}
+
+// Verify returns whether the passed DER-encoded signature is a signature of
+// the hash by the key.
+func (k PublicKey) Verify(hash []byte, signature []byte) bool {
+	sig, err := secp256k1.ParseDERSignature(signature)
+	if err != nil {
+		return false
+	}
+	return sig.Verify(hash, k.pubKey())
+}
+
+// VerifyInputSignature returns whether the passed signature, as pushed by a
+// signature script and returned by InputSignature(), signs the input at the
+// passed index of the transaction committing to the passed script.
+func (k PublicKey) VerifyInputSignature(tx *coinharness.MessageTx, index int, script []byte, signature []byte) bool {
+	if len(signature) == 0 {
+		return false
+	}
+	wireTx, err := TransactionTxToRawErr(tx)
+	if err != nil {
+		return false
+	}
+	hashType := txscript.SigHashType(signature[len(signature)-1])
+	hash, err := txscript.CalcSignatureHash(script, hashType, wireTx, index,
+		nil)
+	if err != nil {
+		return false
+	}
+	return k.Verify(hash, signature[:len(signature)-1])
+}
+
+// Address returns the address of the passed type receiving to the key, the
+// same address KeyAddress() returns for the private key. The Ed25519 keys are
+// derived from the private key, so the Ed25519 address types are not
+// supported.
+func (k PublicKey) Address(addrType AddressType, net coinharness.Network) (coinharness.Address, error) {
+	addr, err := pubKeyAddress(k.pubKey(), addrType,
+		net.Params().(*chaincfg.Params))
+	if err != nil {
+		return nil, err
+	}
+	return &Address{Address: addr}, nil
+}
+
+// RedeemScript returns the redeem script of the P2SHAddress of the key.
+func (k PublicKey) RedeemScript() ([]byte, error) {
+	return pubKeyRedeemScript(k.pubKey())
+}
+
+// PubKeyAddress returns the pay-to-pubkey address of the key.
+func (k PublicKey) PubKeyAddress(net coinharness.Network) (coinharness.Address, error) {
+	return k.Address(P2PKAddress, net)
+}
+
+// PubKeyHashAddress returns the pay-to-pubkey-hash address of the key.
+func (k PublicKey) PubKeyHashAddress(net coinharness.Network) (coinharness.Address, error) {
+	return k.Address(P2PKHAddress, net)
+}
+
+// ScriptHashAddress returns the pay-to-script-hash address of the redeem
+// script paying to the key.
+func (k PublicKey) ScriptHashAddress(net coinharness.Network) (coinharness.Address, error) {
+	return k.Address(P2SHAddress, net)
+}
+
+// SchnorrPubKeyAddress returns the pay-to-pubkey address of the key verifying
+// secp256k1 Schnorr signatures.
+func (k PublicKey) SchnorrPubKeyAddress(net coinharness.Network) (coinharness.Address, error) {
+	return k.Address(SchnorrP2PKAddress, net)
+}
+
+// SchnorrPubKeyHashAddress returns the pay-to-pubkey-hash address of the key
+// verifying secp256k1 Schnorr signatures.
+func (k PublicKey) SchnorrPubKeyHashAddress(net coinharness.Network) (coinharness.Address, error) {
+	return k.Address(SchnorrP2PKHAddress, net)
+}
+
 type ExtendedKey struct {
 	legacy *hdkeychain.ExtendedKey
 }
@@ -0,0 +1,398 @@
+package btcharness
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/jfixby/coinharness"
+	"github.com/picfight/pfcd/blockchain"
+	"github.com/picfight/pfcd/chaincfg"
+	"github.com/picfight/pfcd/chaincfg/chainhash"
+	"github.com/picfight/pfcd/rpcclient"
+	"github.com/picfight/pfcd/wire"
+)
+
+// DifficultyHeadersCount returns the number of headers preceding a new block
+// which are required to calculate its difficulty.
+func DifficultyHeadersCount(net *chaincfg.Params) int64 {
+	return net.WorkDiffWindowSize*net.WorkDiffWindows + 1
+}
+
+// FetchDifficultyHeaders fetches from the node the header chain ending with the
+// passed block as required by the CalcNextRequiredDifficulty.
+func FetchDifficultyHeaders(client coinharness.RPCClient, hash *chainhash.Hash, net *chaincfg.Params) ([]*wire.BlockHeader, error) {
+	return FetchHeaders(client, hash, DifficultyHeadersCount(net))
+}
+
+// FetchHeaders fetches from the node up to count headers of the chain ending
+// with the passed block. The headers are ordered by height.
+func FetchHeaders(client coinharness.RPCClient, hash *chainhash.Hash, count int64) ([]*wire.BlockHeader, error) {
+	rpc := client.Internal().(*rpcclient.Client)
+
+	headers := make([]*wire.BlockHeader, 0, count)
+	for int64(len(headers)) < count {
+		header, err := rpc.GetBlockHeader(hash)
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, header)
+		if header.Height == 0 {
+			break
+		}
+		hash = &header.PrevBlock
+	}
+
+	// Reverse the headers to have them ordered by height.
+	for i, j := 0, len(headers)-1; i < j; i, j = i+1, j-1 {
+		headers[i], headers[j] = headers[j], headers[i]
+	}
+	return headers, nil
+}
+
+// CalcNextRequiredDifficulty calculates the required difficulty for the block
+// after the last of the passed headers based on the difficulty retarget rules.
+// It mirrors the node's calculation for networks which don't rely on an
+// external difficulty algorithm. The headers must be ordered by height and
+// either reach back to the genesis block or contain at least
+// DifficultyHeadersCount entries.
+func CalcNextRequiredDifficulty(headers []*wire.BlockHeader, newBlockTime time.Time, net *chaincfg.Params) (uint32, error) {
+	if len(headers) == 0 {
+		return 0, fmt.Errorf("no headers to calculate difficulty from")
+	}
+	curIndex := len(headers) - 1
+	curNode := headers[curIndex]
+
+	// Get the old difficulty; if we aren't at a block height where it
+	// changes, just return this.
+	oldDiff := curNode.Bits
+	oldDiffBig := blockchain.CompactToBig(curNode.Bits)
+
+	// We're not at a retarget point, return the oldDiff.
+	if (int64(curNode.Height)+1)%net.WorkDiffWindowSize != 0 {
+		// For networks that support it, allow special reduction of the
+		// required difficulty once too much time has elapsed without
+		// mining a block.
+		if net.ReduceMinDifficulty {
+			// Return minimum difficulty when more than the desired
+			// amount of time has elapsed without mining a block.
+			reductionTime := int64(net.MinDiffReductionTime /
+				time.Second)
+			allowMinTime := curNode.Timestamp.Unix() + reductionTime
+			if newBlockTime.Unix() > allowMinTime {
+				return net.PowLimitBits, nil
+			}
+
+			// The block was mined within the desired timeframe, so
+			// return the difficulty for the last block which did
+			// not have the special minimum difficulty rule applied.
+			return findPrevTestNetDifficulty(headers, net), nil
+		}
+
+		return oldDiff, nil
+	}
+
+	// Declare some useful variables.
+	RAFBig := big.NewInt(net.RetargetAdjustmentFactor)
+	nextDiffBigMin := blockchain.CompactToBig(curNode.Bits)
+	nextDiffBigMin.Div(nextDiffBigMin, RAFBig)
+	nextDiffBigMax := blockchain.CompactToBig(curNode.Bits)
+	nextDiffBigMax.Mul(nextDiffBigMax, RAFBig)
+
+	alpha := net.WorkDiffAlpha
+
+	// Number of nodes to traverse while calculating difficulty.
+	nodesToTraverse := net.WorkDiffWindowSize * net.WorkDiffWindows
+
+	// Initialize bigInt slice for the percentage changes for each window
+	// period above or below the target.
+	windowChanges := make([]*big.Int, net.WorkDiffWindows)
+	targetTimespan := int64(net.TargetTimespan / time.Second)
+
+	// Regress through all of the previous blocks and store the percent
+	// changes per window period; use bigInts to emulate 64.32 bit fixed
+	// point.
+	var olderTime, windowPeriod int64
+	var weights uint64
+	oldIndex := curIndex
+	recentTime := curNode.Timestamp.Unix()
+
+	for i := int64(0); ; i++ {
+		oldNode := headers[oldIndex]
+
+		// Store and reset after reaching the end of every window period.
+		if i%net.WorkDiffWindowSize == 0 && i != 0 {
+			olderTime = oldNode.Timestamp.Unix()
+			timeDifference := recentTime - olderTime
+
+			// Just assume we're at the target (no change) if we've
+			// gone all the way back to the genesis block.
+			if oldNode.Height == 0 {
+				timeDifference = targetTimespan
+			}
+
+			timeDifBig := big.NewInt(timeDifference)
+			timeDifBig.Lsh(timeDifBig, 32) // Add padding
+			targetTemp := big.NewInt(targetTimespan)
+
+			windowAdjusted := targetTemp.Div(timeDifBig, targetTemp)
+
+			// Weight it exponentially. Be aware that this could at
+			// some point overflow if alpha or the number of blocks
+			// used is really large.
+			windowAdjusted = windowAdjusted.Lsh(windowAdjusted,
+				uint((net.WorkDiffWindows-windowPeriod)*alpha))
+
+			// Sum up all the different weights incrementally.
+			weights += 1 << uint64((net.WorkDiffWindows-windowPeriod)*
+				alpha)
+
+			// Store it in the slice.
+			windowChanges[windowPeriod] = windowAdjusted
+
+			windowPeriod++
+
+			recentTime = olderTime
+		}
+
+		if i == nodesToTraverse {
+			break // Exit for loop when we hit the end.
+		}
+
+		// Get the previous node while staying at the genesis block as
+		// needed.
+		if oldIndex > 0 {
+			oldIndex--
+		} else if oldNode.Height != 0 {
+			return 0, fmt.Errorf("not enough headers to calculate "+
+				"difficulty of block %v: got %v, need %v",
+				curNode.Height+1, len(headers),
+				DifficultyHeadersCount(net))
+		}
+	}
+
+	// Sum up the weighted window periods.
+	weightedSum := big.NewInt(0)
+	for i := int64(0); i < net.WorkDiffWindows; i++ {
+		weightedSum.Add(weightedSum, windowChanges[i])
+	}
+
+	// Divide by the sum of all weights.
+	weightsBig := big.NewInt(int64(weights))
+	weightedSumDiv := weightedSum.Div(weightedSum, weightsBig)
+
+	// Multiply by the old diff.
+	nextDiffBig := weightedSumDiv.Mul(weightedSumDiv, oldDiffBig)
+
+	// Right shift to restore the original padding (restore non-fixed
+	// point).
+	nextDiffBig = nextDiffBig.Rsh(nextDiffBig, 32)
+
+	// Check to see if we're over the limits for the maximum allowable
+	// retarget; if we are, return the maximum or minimum except in the
+	// case that oldDiff is zero.
+	if oldDiffBig.Sign() != 0 {
+		switch {
+		case nextDiffBig.Sign() == 0:
+			nextDiffBig.Set(net.PowLimit)
+		case nextDiffBig.Cmp(nextDiffBigMax) == 1:
+			nextDiffBig.Set(nextDiffBigMax)
+		case nextDiffBig.Cmp(nextDiffBigMin) == -1:
+			nextDiffBig.Set(nextDiffBigMin)
+		}
+	}
+
+	// Limit new value to the proof of work limit.
+	if nextDiffBig.Cmp(net.PowLimit) > 0 {
+		nextDiffBig.Set(net.PowLimit)
+	}
+
+	return blockchain.BigToCompact(nextDiffBig), nil
+}
+
+// findPrevTestNetDifficulty returns the difficulty of the last of the passed
+// headers which did not have the special testnet minimum difficulty rule
+// applied.
+func findPrevTestNetDifficulty(headers []*wire.BlockHeader, net *chaincfg.Params) uint32 {
+	// Search backwards through the chain for the last block without
+	// the special rule applied.
+	blocksPerRetarget := net.WorkDiffWindowSize * net.WorkDiffWindows
+	for i := len(headers) - 1; i >= 0; i-- {
+		header := headers[i]
+		if int64(header.Height)%blocksPerRetarget == 0 ||
+			header.Bits != net.PowLimitBits {
+			return header.Bits
+		}
+	}
+
+	// Return the minimum difficulty if no appropriate block was found.
+	return net.PowLimitBits
+}
+
+// StakeDifficultyHeadersCount returns the number of headers preceding a new
+// block which are required to calculate its stake difficulty.
+func StakeDifficultyHeadersCount(net *chaincfg.Params) int64 {
+	return net.StakeDiffWindowSize + int64(net.TicketMaturity) + 1
+}
+
+// FetchStakeDifficultyHeaders fetches from the node the header chain ending
+// with the passed block as required by the CalcNextRequiredStakeDifficulty.
+func FetchStakeDifficultyHeaders(client coinharness.RPCClient, hash *chainhash.Hash, net *chaincfg.Params) ([]*wire.BlockHeader, error) {
+	return FetchHeaders(client, hash, StakeDifficultyHeadersCount(net))
+}
+
+// CalcNextRequiredStakeDifficulty calculates the stake difficulty (ticket
+// price) of the block after the last of the passed headers. It mirrors the
+// node's calculation defined in DCP0001, which the node applies
+// unconditionally on the main, test and simulation networks. Other networks
+// select the algorithm by an agenda vote and are not supported. The headers
+// must be ordered by height and either reach back to the genesis block or
+// contain at least StakeDifficultyHeadersCount entries.
+func CalcNextRequiredStakeDifficulty(headers []*wire.BlockHeader, net *chaincfg.Params) (int64, error) {
+	if len(headers) == 0 {
+		return 0, fmt.Errorf("no headers to calculate stake difficulty " +
+			"from")
+	}
+	switch net.Net {
+	case wire.PicfightCoinWire, wire.TestNet3, wire.SimNet:
+	default:
+		return 0, fmt.Errorf("stake difficulty algorithm of network %v "+
+			"is selected by an agenda vote and is not supported",
+			net.Name)
+	}
+	curNode := headers[len(headers)-1]
+	curHeight := int64(curNode.Height)
+
+	// Stake difficulty before any tickets could possibly be purchased is
+	// the minimum value.
+	nextHeight := curHeight + 1
+	if nextHeight < int64(net.CoinbaseMaturity)+1 {
+		return net.MinimumStakeDiff, nil
+	}
+
+	// Return the previous block's difficulty requirements if the next
+	// block is not at a difficulty retarget interval.
+	curDiff := curNode.SBits
+	if nextHeight%net.StakeDiffWindowSize != 0 {
+		return curDiff, nil
+	}
+
+	// ancestor returns the header at the passed height, nil below the
+	// genesis block.
+	ancestor := func(height int64) (*wire.BlockHeader, error) {
+		if height < 0 {
+			return nil, nil
+		}
+		index := len(headers) - 1 - int(curHeight-height)
+		if index < 0 {
+			return nil, fmt.Errorf("not enough headers to calculate "+
+				"stake difficulty of block %v: got %v, need %v",
+				nextHeight, len(headers),
+				StakeDifficultyHeadersCount(net))
+		}
+		return headers[index], nil
+	}
+	// sumPurchasedTickets returns the number of tickets purchased in the
+	// blocks up to the passed height which are still immature.
+	sumPurchasedTickets := func(height int64) (int64, error) {
+		var purchased int64
+		for i := int64(0); i < int64(net.TicketMaturity); i++ {
+			header, err := ancestor(height - i)
+			if err != nil {
+				return 0, err
+			}
+			if header == nil {
+				break
+			}
+			purchased += int64(header.FreshStake)
+		}
+		return purchased, nil
+	}
+
+	// Get the pool size and number of tickets that were immature at the
+	// previous retarget interval, relative to the block before it.
+	prevRetargetHeight := nextHeight - net.StakeDiffWindowSize - 1
+	prevRetarget, err := ancestor(prevRetargetHeight)
+	if err != nil {
+		return 0, err
+	}
+	var prevPoolSize int64
+	if prevRetarget != nil {
+		prevPoolSize = int64(prevRetarget.PoolSize)
+	}
+	prevImmatureTickets, err := sumPurchasedTickets(prevRetargetHeight)
+	if err != nil {
+		return 0, err
+	}
+
+	// Return the existing ticket price for the first few intervals to
+	// avoid division by zero and encourage initial pool population.
+	prevPoolSizeAll := prevPoolSize + prevImmatureTickets
+	if prevPoolSizeAll == 0 {
+		return curDiff, nil
+	}
+	immatureTickets, err := sumPurchasedTickets(curHeight)
+	if err != nil {
+		return 0, err
+	}
+	curPoolSizeAll := int64(curNode.PoolSize) + immatureTickets
+
+	//                   curDiff * curPoolSizeAll^2
+	//   nextDiff = -----------------------------------
+	//              prevPoolSizeAll * targetPoolSizeAll
+	votesPerBlock := int64(net.TicketsPerBlock)
+	ticketPoolSize := int64(net.TicketPoolSize)
+	targetPoolSizeAll := votesPerBlock *
+		(ticketPoolSize + int64(net.TicketMaturity))
+	curPoolSizeAllBig := big.NewInt(curPoolSizeAll)
+	nextDiffBig := big.NewInt(curDiff)
+	nextDiffBig.Mul(nextDiffBig, curPoolSizeAllBig)
+	nextDiffBig.Mul(nextDiffBig, curPoolSizeAllBig)
+	nextDiffBig.Div(nextDiffBig, big.NewInt(prevPoolSizeAll))
+	nextDiffBig.Div(nextDiffBig, big.NewInt(targetPoolSizeAll))
+
+	// Limit the new stake difficulty between the minimum allowed stake
+	// difficulty and a maximum value that is relative to the total supply.
+	nextDiff := nextDiffBig.Int64()
+	maximumStakeDiff := estimateSupply(nextHeight, net) / ticketPoolSize
+	if nextDiff > maximumStakeDiff {
+		nextDiff = maximumStakeDiff
+	}
+	if nextDiff < net.MinimumStakeDiff {
+		nextDiff = net.MinimumStakeDiff
+	}
+	return nextDiff, nil
+}
+
+// estimateSupply returns the estimate of the coin supply at the passed height
+// the node bounds the stake difficulty with.
+func estimateSupply(height int64, net *chaincfg.Params) int64 {
+	if net.SubsidyCalculator != nil {
+		return net.SubsidyCalculator().EstimateSupply(height)
+	}
+	if height <= 0 {
+		return 0
+	}
+
+	// Estimate the supply by calculating the full block subsidy for each
+	// reduction interval and multiplying it the number of blocks in the
+	// interval then adding the subsidy produced by number of blocks in the
+	// current interval.
+	params := net.DecredSubsidyParams
+	supply := net.BlockOneSubsidy()
+	reductions := height / params.SubsidyReductionInterval
+	subsidy := params.BaseSubsidy
+	for i := int64(0); i < reductions; i++ {
+		supply += params.SubsidyReductionInterval * subsidy
+
+		subsidy *= params.MulSubsidy
+		subsidy /= params.DivSubsidy
+	}
+	supply += (1 + height%params.SubsidyReductionInterval) * subsidy
+
+	// Blocks 0 and 1 have special subsidy amounts that have already been
+	// added above, so remove what their subsidies would have normally been
+	// which were also added above.
+	supply -= params.BaseSubsidy * 2
+	return supply
+}
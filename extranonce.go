@@ -0,0 +1,46 @@
+package btcharness
+
+import (
+	"math/rand"
+	"sync"
+
+	"github.com/picfight/pfcd/wire"
+)
+
+// ExtraNonceSource provides the initial coinbase extranonces of generated
+// blocks
+type ExtraNonceSource interface {
+	NextExtraNonce() (uint64, error)
+}
+
+// randomExtraNonceSource draws extranonces from the crypto random source as
+// the node's own miner does.
+type randomExtraNonceSource struct{}
+
+func (randomExtraNonceSource) NextExtraNonce() (uint64, error) {
+	return wire.RandomUint64()
+}
+
+// SeededExtraNonceSource is an ExtraNonceSource producing the same sequence of
+// extranonces for the same seed, so generated chains are byte-for-byte
+// reproducible across runs. It is safe for concurrent use, however concurrent
+// block generators sharing it get the extranonces in no particular order.
+type SeededExtraNonceSource struct {
+	mutex sync.Mutex
+	rand  *rand.Rand
+}
+
+// NewSeededExtraNonceSource creates a SeededExtraNonceSource for the passed
+// seed.
+func NewSeededExtraNonceSource(seed int64) *SeededExtraNonceSource {
+	return &SeededExtraNonceSource{
+		rand: rand.New(rand.NewSource(seed)),
+	}
+}
+
+// NextExtraNonce returns the next extranonce of the sequence.
+func (s *SeededExtraNonceSource) NextExtraNonce() (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.rand.Uint64(), nil
+}
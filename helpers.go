@@ -1,15 +1,14 @@
 package btcharness
 
 import (
+	"context"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"github.com/jfixby/coin"
 	"github.com/jfixby/coinharness"
 	"github.com/jfixby/pin"
 	"github.com/picfight/pfcd/dcrutil"
 	"github.com/picfight/pfcd/rpcclient"
-	"math/big"
 	"time"
 
 	"github.com/picfight/pfcd/blockchain"
@@ -28,6 +27,47 @@ type GenerateBlockArgs struct {
 	MineTo        []wire.TxOut
 	MiningAddress dcrutil.Address
 	Network       *chaincfg.Params
+
+	// Context bounds the time spent solving the block,
+	// nil means no limit
+	Context context.Context
+
+	// Bits sets the difficulty target of the block explicitly,
+	// zero means the target is derived from PrevHeaders
+	Bits uint32
+
+	// PrevHeaders is the header chain ending with the previous block
+	// used to calculate the required difficulty of the block,
+	// nil means the network PowLimitBits
+	PrevHeaders []*wire.BlockHeader
+
+	// RetargetDifficulty instructs block generators to fetch PrevHeaders
+	// from the node when they are not supplied
+	RetargetDifficulty bool
+
+	// STxns are the stake transactions (tickets, votes and revocations)
+	// included into the stake tree of the block
+	STxns []*dcrutil.Tx
+
+	// StakeState sets the header stake commitments of the block,
+	// nil leaves them zero
+	StakeState *StakeState
+
+	// FollowStakeState instructs block generators building on the node's
+	// best block to fetch StakeState from the node when it is not supplied
+	FollowStakeState bool
+
+	// Mempool instructs block generators to fill the block with the node's
+	// mempool transactions following Txns, nil means only Txns are included
+	Mempool *MempoolSelection
+
+	// ExtraNonce provides the initial extranonce of the coinbase,
+	// nil means a random one
+	ExtraNonce ExtraNonceSource
+
+	// CoinbasePolicy selects the checks of MineTo beyond the consensus
+	// rules, nil means the outputs have to be standard
+	CoinbasePolicy *CoinbasePolicy
 }
 
 // GenerateAndSubmitBlock creates a block whose contents include the passed
@@ -46,23 +86,34 @@ func GenerateAndSubmitBlock(client coinharness.RPCClient, args *GenerateBlockArg
 // it to the running simnet node. For generating blocks with only a coinbase tx,
 // callers can simply pass nil instead of transactions to be mined.
 // Additionally, a custom block version can be set by the caller. A blockVersion
-// of -1 indicates that the current default block version should be used. An
+// of -1 (CurrentBlockVersion) indicates that the current default block version
+// should be used as resolved by ResolveBlockVersion, the resolved stake version
+// is put into the header unless args.StakeState sets a nonzero one. An
 // uninitialized time.Time should be used for the blockTime parameter if one
 // doesn't wish to set a custom time. The mineTo list of outputs will be added
-// to the coinbase; this is not checked for correctness until the block is
-// submitted; thus, it is the caller's responsibility to ensure that the outputs
-// are correct. If the list is empty, the coinbase reward goes to the wallet
-// managed by the Harness.
+// to the coinbase in place of the output paying the work subsidy; the outputs
+// are checked with ValidateCoinbaseOutputs and a *CoinbaseOutputError is
+// returned before the block is submitted. If the list is empty, the coinbase
+// reward goes to the wallet managed by the Harness.
 func GenerateAndSubmitBlockWithCustomCoinbaseOutputs(client coinharness.RPCClient, args *GenerateBlockArgs) (*dcrutil.Block, error) {
 	txns := args.Txns
 	blockVersion := args.BlockVersion
-	pin.AssertTrue(fmt.Sprintf("Incorrect blockVersion(%v)", blockVersion), blockVersion > 0)
+	pin.AssertTrue(fmt.Sprintf("Incorrect blockVersion(%v)", blockVersion),
+		blockVersion > 0 || blockVersion == CurrentBlockVersion)
 	blockTime := args.BlockTime
 	mineTo := args.MineTo
 	miningAddress := args.MiningAddress
 	network := args.Network
 
-	pin.AssertTrue("blockVersion != -1", blockVersion != -1)
+	var stakeVersion uint32
+	if blockVersion == CurrentBlockVersion {
+		var err error
+		blockVersion, stakeVersion, err = ResolveBlockVersion(client,
+			network)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	prevBlockHash, prevBlockHeight, err := client.Internal().(*rpcclient.Client).GetBestBlock()
 	if err != nil {
@@ -75,9 +126,54 @@ func GenerateAndSubmitBlockWithCustomCoinbaseOutputs(client coinharness.RPCClien
 	prevBlock := dcrutil.NewBlock(mBlock)
 	mBlock.Header.Height = uint32(prevBlockHeight)
 
+	prevHeaders := args.PrevHeaders
+	if args.RetargetDifficulty && args.Bits == 0 && prevHeaders == nil {
+		prevHeaders, err = FetchDifficultyHeaders(client,
+			prevBlockHash, network)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	stakeState := args.StakeState
+	if args.FollowStakeState && stakeState == nil {
+		stakeState, err = FetchStakeState(client, network)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if stakeVersion != 0 && (stakeState == nil || stakeState.StakeVersion == 0) {
+		withVersion := StakeState{}
+		if stakeState != nil {
+			withVersion = *stakeState
+		}
+		withVersion.StakeVersion = stakeVersion
+		stakeState = &withVersion
+	}
+
+	if args.Mempool != nil {
+		txns, err = selectTemplateTxns(client, prevBlockHeight, args)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Create a new block including the specified transactions
-	newBlock, err := CreateBlock(prevBlock, txns, blockVersion,
-		blockTime, miningAddress, mineTo, network)
+	newBlock, err := CreateBlockWithArgs(prevBlock, &GenerateBlockArgs{
+		Txns:           txns,
+		BlockVersion:   blockVersion,
+		BlockTime:      blockTime,
+		MineTo:         mineTo,
+		MiningAddress:  miningAddress,
+		Network:        network,
+		Context:        args.Context,
+		Bits:           args.Bits,
+		PrevHeaders:    prevHeaders,
+		STxns:          args.STxns,
+		StakeState:     stakeState,
+		ExtraNonce:     args.ExtraNonce,
+		CoinbasePolicy: args.CoinbasePolicy,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -98,6 +194,47 @@ func GenerateAndSubmitBlockWithCustomCoinbaseOutputs(client coinharness.RPCClien
 func CreateBlock(prevBlock *dcrutil.Block, inclusionTxs []*dcrutil.Tx,
 	blockVersion int32, blockTime time.Time, miningAddr dcrutil.Address,
 	mineTo []wire.TxOut, net *chaincfg.Params) (*dcrutil.Block, error) {
+	return CreateBlockContext(context.Background(), prevBlock, inclusionTxs,
+		blockVersion, blockTime, miningAddr, mineTo, net)
+}
+
+// CreateBlockContext is identical to CreateBlock but gives up solving the
+// block and returns an error once the passed context is done.
+func CreateBlockContext(ctx context.Context, prevBlock *dcrutil.Block,
+	inclusionTxs []*dcrutil.Tx, blockVersion int32, blockTime time.Time,
+	miningAddr dcrutil.Address, mineTo []wire.TxOut,
+	net *chaincfg.Params) (*dcrutil.Block, error) {
+	return CreateBlockWithArgs(prevBlock, &GenerateBlockArgs{
+		Txns:          inclusionTxs,
+		BlockVersion:  blockVersion,
+		BlockTime:     blockTime,
+		MineTo:        mineTo,
+		MiningAddress: miningAddr,
+		Network:       net,
+		Context:       ctx,
+	})
+}
+
+// CreateBlockWithArgs is identical to CreateBlock but takes the block
+// parameters bundled in GenerateBlockArgs. When args.Bits is zero and
+// args.PrevHeaders are supplied, the block is solved against the difficulty
+// required by the retarget rules instead of the network PowLimitBits.
+// The stake tree is filled with args.STxns and the coinbase pays the subsidy
+// for the number of votes among them. There is no node to resolve a block
+// version of CurrentBlockVersion with, so it selects the DefaultBlockVersion
+// of the network the node's own miner uses, and the stake version is taken
+// from args.StakeState as is. Callers building on a node's chain resolve both
+// with ResolveBlockVersion first.
+func CreateBlockWithArgs(prevBlock *dcrutil.Block, args *GenerateBlockArgs) (*dcrutil.Block, error) {
+	inclusionTxs := args.Txns
+	blockVersion := args.BlockVersion
+	if blockVersion == CurrentBlockVersion {
+		blockVersion = DefaultBlockVersion(args.Network)
+	}
+	blockTime := args.BlockTime
+	miningAddr := args.MiningAddress
+	mineTo := args.MineTo
+	net := args.Network
 
 	var (
 		prevHash      *chainhash.Hash
@@ -128,13 +265,52 @@ func CreateBlock(prevBlock *dcrutil.Block, inclusionTxs []*dcrutil.Tx,
 		ts = prevBlockTime.Add(time.Second)
 	}
 
+	bits := args.Bits
+	if bits == 0 {
+		bits = net.PowLimitBits
+		if args.PrevHeaders != nil {
+			var err error
+			bits, err = CalcNextRequiredDifficulty(args.PrevHeaders,
+				ts, net)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	extraNonce := uint64(0)
 	coinbaseScript, err := standardCoinbaseScript(blockHeight, extraNonce)
 	if err != nil {
 		return nil, err
 	}
+	extraNonceSource := args.ExtraNonce
+	if extraNonceSource == nil {
+		extraNonceSource = randomExtraNonceSource{}
+	}
+	opReturnExtraNonce, err := extraNonceSource.NextExtraNonce()
+	if err != nil {
+		return nil, err
+	}
+	tickets, voters, revocations, yesVotes := stakeTreeCounts(args.STxns)
+	if len(mineTo) != 0 && !usesBlockOneLedger(blockHeight, net) {
+		// The fees of the stake tree are carried forward to the
+		// coinbase along with the fees of the regular tree.
+		fees, err := txnsFees(inclusionTxs)
+		if err != nil {
+			return nil, err
+		}
+		stakeFees, err := txnsFees(args.STxns)
+		if err != nil {
+			return nil, err
+		}
+		err = ValidateCoinbaseOutputs(mineTo, blockHeight, voters,
+			fees+stakeFees, args.CoinbasePolicy, net)
+		if err != nil {
+			return nil, err
+		}
+	}
 	coinbaseTx, err := createCoinbaseTx(coinbaseScript, blockHeight,
-		miningAddr, mineTo, net)
+		miningAddr, mineTo, voters, opReturnExtraNonce, net)
 	if err != nil {
 		return nil, err
 	}
@@ -145,54 +321,57 @@ func CreateBlock(prevBlock *dcrutil.Block, inclusionTxs []*dcrutil.Tx,
 		blockTxns = append(blockTxns, inclusionTxs...)
 	}
 	merkles := blockchain.BuildMerkleTreeStore(blockTxns)
+	stakeMerkles := blockchain.BuildMerkleTreeStore(args.STxns)
 	var block wire.MsgBlock
 	block.Header = wire.BlockHeader{
-		Version:    blockVersion,
-		PrevBlock:  *prevHash,
-		MerkleRoot: *merkles[len(merkles)-1],
-		Timestamp:  ts,
-		Bits:       net.PowLimitBits,
+		Version:     blockVersion,
+		PrevBlock:   *prevHash,
+		MerkleRoot:  *merkles[len(merkles)-1],
+		StakeRoot:   *stakeMerkles[len(stakeMerkles)-1],
+		Voters:      voters,
+		FreshStake:  uint8(tickets),
+		Revocations: uint8(revocations),
+		Timestamp:   ts,
+		Bits:        bits,
+		Height:      uint32(blockHeight),
+	}
+	if stakeState := args.StakeState; stakeState != nil {
+		block.Header.VoteBits = stakeState.VoteBits
+		block.Header.FinalState = stakeState.FinalState
+		block.Header.PoolSize = stakeState.PoolSize
+		block.Header.SBits = stakeState.SBits
+		block.Header.StakeVersion = stakeState.StakeVersion
+	}
+	// Once the votes are validated the header must approve the previous
+	// block according to the majority of them.
+	if voters > 0 && blockHeight >= net.StakeValidationHeight {
+		block.Header.VoteBits &^= dcrutil.BlockValid
+		if yesVotes > voters-yesVotes {
+			block.Header.VoteBits |= dcrutil.BlockValid
+		}
 	}
 	for _, tx := range blockTxns {
 		if err := block.AddTransaction(tx.MsgTx()); err != nil {
 			return nil, err
 		}
 	}
+	for _, tx := range args.STxns {
+		if err := block.AddSTransaction(tx.MsgTx()); err != nil {
+			return nil, err
+		}
+	}
+	// The header commits to the size of the serialized block, thus it has
+	// to be set before solving.
+	block.Header.Size = uint32(block.SerializeSize())
 
-	found := solveBlock(&block.Header, net.PowLimit)
-	if !found {
-		return nil, errors.New("unable to solve block")
+	if err := solveBlock(args.Context, &block); err != nil {
+		return nil, fmt.Errorf("unable to solve block: %v", err)
 	}
 
 	utilBlock := dcrutil.NewBlock(&block)
-	utilBlock.MsgBlock().Header.Height = uint32(blockHeight)
 	return utilBlock, nil
 }
 
-// solveBlock attempts to find a nonce which makes the passed block header hash
-// to a value less than the target difficulty. When a successful solution is
-// found true is returned and the nonce field of the passed header is updated
-// with the solution. False is returned if no solution exists.
-func solveBlock(header *wire.BlockHeader, targetDifficulty *big.Int) bool {
-	// Note that the entire extra nonce range is iterated and the offset is
-	// added relying on the fact that overflow will wrap around 0 as
-	// provided by the Go spec.
-	for i := uint32(0); ; i++ {
-		// Update the nonce and hash the block header.
-		header.Nonce = i
-		hash := header.BlockHash()
-		// The block is solved when the new block hash is less
-		// than the target difficulty.  Yay!
-		blockHash := blockchain.HashToBig(&hash)
-		if blockHash.Cmp(targetDifficulty) <= 0 {
-			pin.D("       blockHash", blockHash)
-			pin.D("targetDifficulty", targetDifficulty)
-			return true
-		}
-	}
-	return false
-}
-
 // standardCoinbaseScript returns a standard script suitable for use as the
 // signature script of the coinbase transaction of a new block. In particular,
 // it starts with the block height that is required by version 2 blocks.
@@ -206,10 +385,11 @@ func standardCoinbaseScript(nextBlockHeight int64, extraNonce uint64) ([]byte, e
 const TxTreeRegular int8 = 0
 
 // createCoinbaseTx returns a coinbase transaction paying an appropriate
-// subsidy based on the passed block height to the provided address.
+// subsidy based on the passed block height and number of voters to the
+// provided address. The extranonce is encoded into the OP_RETURN output.
 func createCoinbaseTx(coinbaseScript []byte, nextBlockHeight int64,
-	addr dcrutil.Address, mineTo []wire.TxOut,
-	params *chaincfg.Params) (*dcrutil.Tx, error) {
+	addr dcrutil.Address, mineTo []wire.TxOut, voters uint16,
+	extraNonce uint64, params *chaincfg.Params) (*dcrutil.Tx, error) {
 
 	tx := wire.NewMsgTx()
 	tx.AddTxIn(&wire.TxIn{
@@ -224,7 +404,7 @@ func createCoinbaseTx(coinbaseScript []byte, nextBlockHeight int64,
 	})
 
 	// Block one is a special block that might pay out tokens to a ledger.
-	if nextBlockHeight == 1 && len(params.BlockOneLedger) != 0 {
+	if usesBlockOneLedger(nextBlockHeight, params) {
 		// Convert the addresses in the ledger into useable format.
 		addrs := make([]dcrutil.Address, len(params.BlockOneLedger))
 		for i, payout := range params.BlockOneLedger {
@@ -252,17 +432,8 @@ func createCoinbaseTx(coinbaseScript []byte, nextBlockHeight int64,
 		return dcrutil.NewTx(tx), nil
 	}
 
-	subsidyCache := blockchain.NewSubsidyCache(0, params)
-	voters := params.TicketsPerBlock
 	// Create a coinbase with correct block subsidy and extranonce.
-	subsidy := blockchain.CalcBlockWorkSubsidy(subsidyCache,
-		nextBlockHeight,
-		voters,
-		params)
-	tax := blockchain.CalcBlockTaxSubsidy(subsidyCache,
-		nextBlockHeight,
-		voters,
-		params)
+	subsidy, tax := CalcCoinbaseSubsidy(nextBlockHeight, voters, params)
 
 	// Tax output.
 	if params.BlockTaxProportion > 0 {
@@ -283,12 +454,11 @@ func createCoinbaseTx(coinbaseScript []byte, nextBlockHeight int64,
 		})
 	}
 
-	random, err := wire.RandomUint64()
+	height := nextBlockHeight
+	opReturnPkScript, err := standardCoinbaseOpReturn(height, extraNonce)
 	if err != nil {
 		return nil, err
 	}
-	height := nextBlockHeight
-	opReturnPkScript, err := standardCoinbaseOpReturn(height, random)
 
 	// Extranonce.
 	tx.AddTxOut(&wire.TxOut{
@@ -298,6 +468,15 @@ func createCoinbaseTx(coinbaseScript []byte, nextBlockHeight int64,
 	// ValueIn.
 	tx.TxIn[0].ValueIn = subsidy + tax
 
+	// Custom outputs replace the output paying the subsidy to the miner.
+	if len(mineTo) != 0 {
+		for i := range mineTo {
+			txOut := mineTo[i]
+			tx.AddTxOut(&txOut)
+		}
+		return dcrutil.NewTx(tx), nil
+	}
+
 	// Create the script to pay to the provided payment address if one was
 	// specified.  Otherwise create a script that allows the coinbase to be
 	// redeemable by anyone.
@@ -325,6 +504,12 @@ func createCoinbaseTx(coinbaseScript []byte, nextBlockHeight int64,
 	return dcrutil.NewTx(tx), nil
 }
 
+// usesBlockOneLedger returns whether the coinbase of the block at the passed
+// height pays out to the network block one ledger.
+func usesBlockOneLedger(height int64, params *chaincfg.Params) bool {
+	return height == 1 && len(params.BlockOneLedger) != 0
+}
+
 // standardCoinbaseOpReturn creates a standard OP_RETURN output to insert into
 // coinbase to use as extranonces. The OP_RETURN pushes 32 bytes.
 func standardCoinbaseOpReturn(height int64, extraNonce uint64) ([]byte, error) {
@@ -339,23 +524,43 @@ func standardCoinbaseOpReturn(height int64, extraNonce uint64) ([]byte, error) {
 	return extraNonceScript, nil
 }
 
+// TransactionTxToRaw converts the passed coinharness.MessageTx into the
+// wire.MsgTx it represents, see TransactionTxToRawErr. It panics with a test
+// setup malfunction when an outpoint hash is not supported by HashToRaw.
 func TransactionTxToRaw(chTx *coinharness.MessageTx) *wire.MsgTx {
+	wireTx, err := TransactionTxToRawErr(chTx)
+	pin.CheckTestSetupMalfunction(err)
+	return wireTx
+}
+
+// TransactionTxToRawErr converts the passed coinharness.MessageTx into the
+// wire.MsgTx it represents. Every field is carried over, so the conversion is
+// the inverse of TransactionRawToTx and preserves the transaction hash. An
+// error is returned when an outpoint hash is not supported by HashToRaw.
+func TransactionTxToRawErr(chTx *coinharness.MessageTx) (*wire.MsgTx, error) {
 	wireTx := &wire.MsgTx{
-		//CachedHash: chTx.CachedHash.(*chainhash.Hash),
+		// The cached hash is not carried over, it is recalculated on
+		// demand from the converted fields.
 		SerType:  wire.TxSerializeType(chTx.SerType),
 		Version:  uint16(chTx.Version),
 		LockTime: chTx.LockTime,
 		Expiry:   chTx.Expiry,
 	}
 	for _, ti := range chTx.TxIn {
+		hash, err := HashToRaw(ti.PreviousOutPoint.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert the outpoint "+
+				"of input %v: %v", len(wireTx.TxIn), err)
+		}
 		wireTx.TxIn = append(wireTx.TxIn,
 			&wire.TxIn{
 				ValueIn:         ti.ValueIn.ToAtoms(),
+				Sequence:        ti.Sequence,
 				SignatureScript: ti.SignatureScript,
 				BlockHeight:     ti.BlockHeight,
 				BlockIndex:      ti.BlockIndex,
 				PreviousOutPoint: wire.OutPoint{
-					Hash:  ti.PreviousOutPoint.Hash.(chainhash.Hash),
+					Hash:  hash,
 					Index: ti.PreviousOutPoint.Index,
 					Tree:  ti.PreviousOutPoint.Tree,
 				},
@@ -372,13 +577,16 @@ func TransactionTxToRaw(chTx *coinharness.MessageTx) *wire.MsgTx {
 		)
 	}
 
-	return wireTx
+	return wireTx, nil
 }
 
+// TransactionRawToTx converts the passed wire.MsgTx into a
+// coinharness.MessageTx holding a copy of every field. The TxHash function of
+// the result hashes its current fields, so it stays valid when they are
+// modified.
 func TransactionRawToTx(wireTx *wire.MsgTx) *coinharness.MessageTx {
 	wireTx = wireTx.Copy()
 	chTx := &coinharness.MessageTx{
-		//CachedHash: wireTx.CachedHash,
 		SerType:  uint16(wireTx.SerType),
 		Version:  int32(wireTx.Version),
 		LockTime: wireTx.LockTime,
@@ -387,7 +595,8 @@ func TransactionRawToTx(wireTx *wire.MsgTx) *coinharness.MessageTx {
 	for _, ti := range wireTx.TxIn {
 		chTx.TxIn = append(chTx.TxIn,
 			&coinharness.TxIn{
-				ValueIn:         coin.Amount{ti.ValueIn},
+				ValueIn:         coin.Amount{AtomsValue: ti.ValueIn},
+				Sequence:        ti.Sequence,
 				SignatureScript: ti.SignatureScript,
 				BlockHeight:     ti.BlockHeight,
 				BlockIndex:      ti.BlockIndex,
@@ -402,7 +611,7 @@ func TransactionRawToTx(wireTx *wire.MsgTx) *coinharness.MessageTx {
 	for _, to := range wireTx.TxOut {
 		chTx.TxOut = append(chTx.TxOut,
 			&coinharness.TxOut{
-				Value:    coin.Amount{to.Value},
+				Value:    coin.Amount{AtomsValue: to.Value},
 				Version:  to.Version,
 				PkScript: to.PkScript,
 			},
@@ -410,12 +619,74 @@ func TransactionRawToTx(wireTx *wire.MsgTx) *coinharness.MessageTx {
 	}
 
 	chTx.TxHash = func() coinharness.Hash {
-		return wireTx.TxHash()
+		return TransactionTxToRaw(chTx).TxHash()
 	}
 
 	return chTx
 }
 
+// HashToRaw returns the chainhash.Hash held by the passed coinharness.Hash,
+// which is either a chainhash.Hash or a *chainhash.Hash.
+func HashToRaw(hash coinharness.Hash) (chainhash.Hash, error) {
+	switch h := hash.(type) {
+	case chainhash.Hash:
+		return h, nil
+	case *chainhash.Hash:
+		if h == nil {
+			return chainhash.Hash{}, fmt.Errorf("nil hash")
+		}
+		return *h, nil
+	}
+	return chainhash.Hash{}, fmt.Errorf("unsupported hash type %T", hash)
+}
+
+// BlockHeaderRawToHeader wraps a copy of the passed wire.BlockHeader into a
+// BlockHeader.
+func BlockHeaderRawToHeader(header *wire.BlockHeader) *BlockHeader {
+	return &BlockHeader{legacy: *header}
+}
+
+// BlockHeaderToRaw returns a copy of the wire.BlockHeader wrapped by the passed
+// BlockHeader.
+func BlockHeaderToRaw(header *BlockHeader) *wire.BlockHeader {
+	raw := header.legacy
+	return &raw
+}
+
+// BlockRawToBlock converts the passed wire.MsgBlock into a MsgBlock holding a
+// copy of the header and of every transaction of both trees.
+func BlockRawToBlock(block *wire.MsgBlock) *MsgBlock {
+	chBlock := &MsgBlock{
+		Header: BlockHeaderRawToHeader(&block.Header),
+	}
+	for _, tx := range block.Transactions {
+		chBlock.Transactions = append(chBlock.Transactions,
+			TransactionRawToTx(tx))
+	}
+	for _, tx := range block.STransactions {
+		chBlock.STransactions = append(chBlock.STransactions,
+			TransactionRawToTx(tx))
+	}
+	return chBlock
+}
+
+// BlockToRaw converts the passed MsgBlock into the wire.MsgBlock it represents,
+// it is the inverse of BlockRawToBlock and preserves the block hash.
+func BlockToRaw(chBlock *MsgBlock) *wire.MsgBlock {
+	block := &wire.MsgBlock{
+		Header: *BlockHeaderToRaw(chBlock.Header),
+	}
+	for _, tx := range chBlock.Transactions {
+		block.Transactions = append(block.Transactions,
+			TransactionTxToRaw(tx))
+	}
+	for _, tx := range chBlock.STransactions {
+		block.STransactions = append(block.STransactions,
+			TransactionTxToRaw(tx))
+	}
+	return block
+}
+
 func PayToAddrScript(addr coinharness.Address) ([]byte, error) {
 	return txscript.PayToAddrScript(addr.Internal().(dcrutil.Address))
 }
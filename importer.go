@@ -0,0 +1,150 @@
+package btcharness
+
+import (
+	"fmt"
+
+	"github.com/jfixby/coinharness"
+	"github.com/jfixby/pin"
+	"github.com/picfight/pfcd/chaincfg"
+	"github.com/picfight/pfcd/dcrutil"
+	"github.com/picfight/pfcd/rpcclient"
+)
+
+// ImportBlocksArgs bundles ImportBlocks() arguments to minimize diff
+// in case a new argument for the function is added
+type ImportBlocksArgs struct {
+	// Blocks are the blocks to import ordered by height,
+	// nil means the blocks are read from Path
+	Blocks []*dcrutil.Block
+
+	// Path is a bootstrap file written by WriteBootstrapFile
+	Path string
+
+	Network *chaincfg.Params
+
+	// BatchSize is the number of blocks submitted before waiting for the
+	// node to reply, zero means 1
+	BatchSize int
+
+	// Progress is called after every batch, nil means no reporting
+	Progress func(progress *ImportProgress)
+}
+
+// ImportProgress reports the state of ImportBlocks()
+type ImportProgress struct {
+	// Total is the number of blocks in the fixture
+	Total int
+
+	// Skipped is the number of blocks the node already had
+	Skipped int
+
+	// Submitted is the number of blocks submitted so far
+	Submitted int
+
+	// Height is the height of the last submitted block
+	Height int64
+}
+
+// ImportBlocks submits the fixture blocks to the node. Blocks at or below the
+// node's current height are skipped after checking that the node's chain
+// matches the fixture, so an interrupted import can be resumed. An error is
+// returned unless the node's best block ends up being the fixture tip.
+func ImportBlocks(client coinharness.RPCClient, args *ImportBlocksArgs) (*ImportProgress, error) {
+	pin.AssertNotNil("args.Network", args.Network)
+	rpc := client.Internal().(*rpcclient.Client)
+
+	blocks := args.Blocks
+	if blocks == nil {
+		var err error
+		blocks, err = ReadBootstrapFile(args.Path, args.Network)
+		if err != nil {
+			return nil, err
+		}
+	}
+	progress := &ImportProgress{Total: len(blocks)}
+	if len(blocks) == 0 {
+		return progress, nil
+	}
+
+	_, bestHeight, err := rpc.GetBestBlock()
+	if err != nil {
+		return nil, err
+	}
+	start, err := importResumeIndex(rpc, blocks, bestHeight)
+	if err != nil {
+		return nil, err
+	}
+	progress.Skipped = start
+
+	batchSize := args.BatchSize
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	for i := start; i < len(blocks); i += batchSize {
+		end := i + batchSize
+		if end > len(blocks) {
+			end = len(blocks)
+		}
+		batch := blocks[i:end]
+
+		results := make([]rpcclient.FutureSubmitBlockResult, len(batch))
+		for j, block := range batch {
+			results[j] = rpc.SubmitBlockAsync(block, nil)
+		}
+		for j, result := range results {
+			if err := result.Receive(); err != nil {
+				return progress, fmt.Errorf("block %v at height %v "+
+					"rejected: %v", batch[j].Hash(),
+					batch[j].Height(), err)
+			}
+			progress.Submitted++
+			progress.Height = batch[j].Height()
+		}
+		if args.Progress != nil {
+			args.Progress(progress)
+		}
+	}
+
+	tip := blocks[len(blocks)-1]
+	bestHash, bestHeight, err := rpc.GetBestBlock()
+	if err != nil {
+		return progress, err
+	}
+	if *bestHash != *tip.Hash() {
+		return progress, fmt.Errorf("node best block %v (height %v) does "+
+			"not match the fixture tip %v (height %v)", bestHash,
+			bestHeight, tip.Hash(), tip.Height())
+	}
+	return progress, nil
+}
+
+// importResumeIndex returns the index of the first fixture block above the
+// node's best height. An error is returned when the node's main chain differs
+// from the fixture at that height.
+func importResumeIndex(rpc *rpcclient.Client, blocks []*dcrutil.Block, bestHeight int64) (int, error) {
+	first := blocks[0].Height()
+	if bestHeight < first {
+		return 0, nil
+	}
+	index := int(bestHeight - first)
+	if index >= len(blocks) {
+		index = len(blocks) - 1
+	}
+	block := blocks[index]
+	if block.Height() != first+int64(index) {
+		return 0, fmt.Errorf("fixture blocks are not ordered by height: "+
+			"block %v has height %v, expected %v", block.Hash(),
+			block.Height(), first+int64(index))
+	}
+
+	mainHash, err := rpc.GetBlockHash(block.Height())
+	if err != nil {
+		return 0, err
+	}
+	if *mainHash != *block.Hash() {
+		return 0, fmt.Errorf("node chain diverges from the fixture at "+
+			"height %v: node has %v, fixture has %v", block.Height(),
+			mainHash, block.Hash())
+	}
+	return index + 1, nil
+}
@@ -0,0 +1,359 @@
+package btcharness
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jfixby/coinharness"
+	"github.com/jfixby/pin"
+	"github.com/picfight/pfcd/blockchain"
+	"github.com/picfight/pfcd/chaincfg"
+	"github.com/picfight/pfcd/chaincfg/chainhash"
+	"github.com/picfight/pfcd/dcrutil"
+	"github.com/picfight/pfcd/rpcclient"
+	"github.com/picfight/pfcd/txscript"
+	"github.com/picfight/pfcd/wire"
+)
+
+// BlockViolation identifies a consensus rule deliberately broken by a block
+// produced with CreateInvalidBlock.
+type BlockViolation int
+
+const (
+	// BadMerkleRoot produces a block whose header commits to a wrong
+	// merkle root of the regular transaction tree.
+	BadMerkleRoot BlockViolation = iota
+
+	// WrongCoinbaseHeight produces a block whose coinbase encodes a wrong
+	// block height.
+	WrongCoinbaseHeight
+
+	// DuplicateTransaction produces a block including the first of the
+	// passed transactions twice.
+	DuplicateTransaction
+
+	// ExcessiveCoinbaseSubsidy produces a block whose coinbase pays the
+	// miner one atom more than the allowed subsidy, block one paying the
+	// ledger is not supported.
+	ExcessiveCoinbaseSubsidy
+
+	// TimestampBeforeMedianTime produces a block whose timestamp is not
+	// after the median time of the previous blocks.
+	TimestampBeforeMedianTime
+
+	// OversizeBlock produces a block exceeding the maximum block size.
+	OversizeBlock
+
+	// BadProofOfWork produces a block whose hash is above the target
+	// difficulty.
+	BadProofOfWork
+
+	// WrongPrevHash produces a block building on an unknown block. The node
+	// is expected to keep such a block as an orphan rather than reject it.
+	WrongPrevHash
+)
+
+// blockViolationInfo describes the node reaction expected for a
+// BlockViolation.
+type blockViolationInfo struct {
+	name string
+	rule blockchain.ErrorCode
+	// reason is a part of the rejection reason reported by the node,
+	// empty when the node is not expected to reject the block
+	reason string
+}
+
+var blockViolations = map[BlockViolation]blockViolationInfo{
+	BadMerkleRoot: {
+		"BadMerkleRoot",
+		blockchain.ErrBadMerkleRoot,
+		"block merkle root is invalid",
+	},
+	WrongCoinbaseHeight: {
+		"WrongCoinbaseHeight",
+		blockchain.ErrCoinbaseHeight,
+		"has wrong height in coinbase",
+	},
+	DuplicateTransaction: {
+		"DuplicateTransaction",
+		blockchain.ErrDuplicateTx,
+		"block contains duplicate transaction",
+	},
+	ExcessiveCoinbaseSubsidy: {
+		"ExcessiveCoinbaseSubsidy",
+		blockchain.ErrBadCoinbaseValue,
+		"which is more than expected value",
+	},
+	TimestampBeforeMedianTime: {
+		"TimestampBeforeMedianTime",
+		blockchain.ErrTimeTooOld,
+		"is not after expected",
+	},
+	OversizeBlock: {
+		"OversizeBlock",
+		blockchain.ErrBlockTooBig,
+		"serialized block is too big",
+	},
+	BadProofOfWork: {
+		"BadProofOfWork",
+		blockchain.ErrHighHash,
+		"is higher than expected max",
+	},
+	WrongPrevHash: {
+		"WrongPrevHash",
+		blockchain.ErrMissingParent,
+		"",
+	},
+}
+
+// String returns the BlockViolation as a human-readable name.
+func (v BlockViolation) String() string {
+	if info, ok := blockViolations[v]; ok {
+		return info.name
+	}
+	return fmt.Sprintf("Unknown BlockViolation (%d)", int(v))
+}
+
+// ExpectedRule returns the consensus rule the node is expected to report for
+// a block breaking this BlockViolation.
+func (v BlockViolation) ExpectedRule() blockchain.ErrorCode {
+	return blockViolations[v].rule
+}
+
+// InvalidBlockResult reports how the node reacted to a block produced with
+// CreateInvalidBlock.
+type InvalidBlockResult struct {
+	Violation BlockViolation
+	Block     *dcrutil.Block
+
+	// ExpectedRule is the consensus rule the block breaks
+	ExpectedRule blockchain.ErrorCode
+
+	// Rejected is true when the node refused the block
+	Rejected bool
+
+	// Reason is the rejection reason reported by the node
+	Reason string
+
+	// Matched is true when the node reacted as expected for the
+	// ExpectedRule
+	Matched bool
+}
+
+// SubmitInvalidBlock creates a block on top of the node's best block breaking
+// the passed consensus rule, submits it and compares the node's reaction to
+// the expected one. An error is returned only when the block can't be created
+// or the node can't be reached; a rejection is reported in the result.
+func SubmitInvalidBlock(client coinharness.RPCClient, violation BlockViolation, args *GenerateBlockArgs) (*InvalidBlockResult, error) {
+	rpc := client.Internal().(*rpcclient.Client)
+
+	prevBlockHash, _, err := rpc.GetBestBlock()
+	if err != nil {
+		return nil, err
+	}
+	mBlock, err := rpc.GetBlock(prevBlockHash)
+	if err != nil {
+		return nil, err
+	}
+	prevBlock := dcrutil.NewBlock(mBlock)
+
+	blockArgs := *args
+	if blockArgs.PrevHeaders == nil {
+		count := DifficultyHeadersCount(args.Network)
+		if count < MedianTimeBlocks {
+			count = MedianTimeBlocks
+		}
+		blockArgs.PrevHeaders, err = FetchHeaders(client, prevBlockHash, count)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if blockArgs.FollowStakeState && blockArgs.StakeState == nil {
+		blockArgs.StakeState, err = FetchStakeState(client, args.Network)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	block, err := CreateInvalidBlock(prevBlock, violation, &blockArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &InvalidBlockResult{
+		Violation:    violation,
+		Block:        block,
+		ExpectedRule: violation.ExpectedRule(),
+	}
+	err = rpc.SubmitBlock(block, nil)
+	if err != nil {
+		const rejectedPrefix = "rejected: "
+		if !strings.HasPrefix(err.Error(), rejectedPrefix) {
+			return nil, err
+		}
+		result.Rejected = true
+		result.Reason = strings.TrimPrefix(err.Error(), rejectedPrefix)
+	}
+
+	expectedReason := blockViolations[violation].reason
+	if expectedReason != "" {
+		result.Matched = result.Rejected &&
+			strings.Contains(result.Reason, expectedReason)
+		return result, nil
+	}
+
+	// The block is expected to be accepted as an orphan and never
+	// connected to the main chain.
+	bestHash, _, err := rpc.GetBestBlock()
+	if err != nil {
+		return nil, err
+	}
+	result.Matched = !result.Rejected && *bestHash != *block.Hash()
+	return result, nil
+}
+
+// CreateInvalidBlock creates a new block building from the previous block
+// the same way CreateBlockWithArgs does and then breaks the passed consensus
+// rule. DuplicateTransaction requires at least one transaction in args.Txns,
+// TimestampBeforeMedianTime requires args.PrevHeaders to cover the last
+// MedianTimeBlocks blocks.
+func CreateInvalidBlock(prevBlock *dcrutil.Block, violation BlockViolation, args *GenerateBlockArgs) (*dcrutil.Block, error) {
+	pin.AssertNotNil("prevBlock", prevBlock)
+	blockArgs := *args
+
+	switch violation {
+	case TimestampBeforeMedianTime:
+		medianTime, err := CalcPastMedianTime(args.PrevHeaders)
+		if err != nil {
+			return nil, err
+		}
+		blockArgs.BlockTime = medianTime
+	case DuplicateTransaction:
+		if len(args.Txns) == 0 {
+			return nil, errors.New("a transaction is required " +
+				"to be duplicated")
+		}
+		blockArgs.Txns = append(append([]*dcrutil.Tx{}, args.Txns...),
+			args.Txns[0])
+	case BadProofOfWork, BadMerkleRoot, WrongCoinbaseHeight,
+		ExcessiveCoinbaseSubsidy, OversizeBlock, WrongPrevHash:
+	default:
+		return nil, fmt.Errorf("unknown block violation: %v", violation)
+	}
+
+	valid, err := CreateBlockWithArgs(prevBlock, &blockArgs)
+	if err != nil {
+		return nil, err
+	}
+	block := valid.MsgBlock()
+	coinbaseTx := block.Transactions[0]
+	height := int64(block.Header.Height)
+
+	switch violation {
+	case TimestampBeforeMedianTime, DuplicateTransaction:
+		// The block was created invalid.
+		return valid, nil
+
+	case BadProofOfWork:
+		// Search for a nonce which doesn't solve the block.
+		target := blockchain.CompactToBig(block.Header.Bits)
+		for {
+			block.Header.Nonce++
+			hash := block.Header.BlockHash()
+			if blockchain.HashToBig(&hash).Cmp(target) > 0 {
+				return dcrutil.NewBlock(block), nil
+			}
+		}
+
+	case BadMerkleRoot:
+		block.Header.MerkleRoot[0] ^= 0xff
+
+	case WrongCoinbaseHeight:
+		wrongHeight := height + 1
+		extraNonce := coinbaseExtraNonce(block)
+		coinbaseScript, err := standardCoinbaseScript(wrongHeight,
+			extraNonce)
+		if err != nil {
+			return nil, err
+		}
+		coinbaseTx.TxIn[0].SignatureScript = coinbaseScript
+		if index := extraNonceOutputIndex(coinbaseTx); index >= 0 {
+			opReturnPkScript, err := standardCoinbaseOpReturn(
+				wrongHeight, extraNonce)
+			if err != nil {
+				return nil, err
+			}
+			coinbaseTx.TxOut[index].PkScript = opReturnPkScript
+		}
+		updateMerkleRootAndSize(block)
+
+	case ExcessiveCoinbaseSubsidy:
+		// Pay the miner one atom more than allowed while keeping the
+		// input value intact.
+		index := minerOutputIndex(coinbaseTx, height, args.Network)
+		if index < 0 {
+			return nil, fmt.Errorf("coinbase of block %v has no "+
+				"output paying the subsidy to the miner", height)
+		}
+		coinbaseTx.TxOut[index].Value++
+		updateMerkleRootAndSize(block)
+
+	case OversizeBlock:
+		maxSize := wire.MaxBlockPayload
+		for _, size := range args.Network.MaximumBlockSizes {
+			if size > maxSize {
+				maxSize = size
+			}
+		}
+		// Pad the block with an unspendable coinbase output.
+		padding := &wire.TxOut{Value: 0}
+		coinbaseTx.AddTxOut(padding)
+		size := block.SerializeSize()
+		scriptLen := maxSize + 1 - size
+		// Account for the growth of the script length varint.
+		scriptLen -= wire.VarIntSerializeSize(uint64(scriptLen)) - 1
+		padding.PkScript = make([]byte, scriptLen)
+		padding.PkScript[0] = txscript.OP_RETURN
+		updateMerkleRootAndSize(block)
+
+	case WrongPrevHash:
+		block.Header.PrevBlock = chainhash.HashH(block.Header.PrevBlock[:])
+	}
+
+	// Solve the altered header without rolling the extranonce as that would
+	// rebuild the merkle root.
+	targetDifficulty := blockchain.CompactToBig(block.Header.Bits)
+	nonce, found, err := solveHeader(args.Context, block.Header,
+		targetDifficulty)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New("unable to solve block")
+	}
+	block.Header.Nonce = nonce
+	return dcrutil.NewBlock(block), nil
+}
+
+// minerOutputIndex returns the index of the first output of the coinbase paying
+// the work subsidy to the miner: the first output following the tax and the
+// extranonce outputs which is not a null data script. -1 is returned for the
+// coinbase of block one paying the ledger, which has no such output.
+func minerOutputIndex(coinbaseTx *wire.MsgTx, height int64, net *chaincfg.Params) int {
+	if usesBlockOneLedger(height, net) {
+		return -1
+	}
+	extraNonceIndex := extraNonceOutputIndex(coinbaseTx)
+	if extraNonceIndex < 0 {
+		return -1
+	}
+	for i := extraNonceIndex + 1; i < len(coinbaseTx.TxOut); i++ {
+		txOut := coinbaseTx.TxOut[i]
+		class := txscript.GetScriptClass(txOut.Version, txOut.PkScript)
+		if class != txscript.NullDataTy {
+			return i
+		}
+	}
+	return -1
+}
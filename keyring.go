@@ -0,0 +1,239 @@
+package btcharness
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/jfixby/coin"
+	"github.com/jfixby/coinharness"
+	"github.com/picfight/pfcd/chaincfg"
+	"github.com/picfight/pfcd/chaincfg/chainec"
+	"github.com/picfight/pfcd/dcrec"
+	"github.com/picfight/pfcd/dcrec/secp256k1"
+	"github.com/picfight/pfcd/dcrutil"
+	"github.com/picfight/pfcd/hdkeychain"
+	"github.com/picfight/pfcd/txscript"
+	"github.com/picfight/pfcd/wire"
+)
+
+// KeyRing holds the private keys and the redeem scripts controlled by the
+// harness indexed by the addresses they unlock. It signs the inputs spending
+// any standard output paying to those addresses, with the signature suite of
+// the address.
+type KeyRing struct {
+	net     *chaincfg.Params
+	keys    map[string]chainec.PrivateKey
+	scripts map[string][]byte
+}
+
+// NewKeyRing creates an empty KeyRing for the passed network.
+func NewKeyRing(net *chaincfg.Params) *KeyRing {
+	return &KeyRing{
+		net:     net,
+		keys:    make(map[string]chainec.PrivateKey),
+		scripts: make(map[string][]byte),
+	}
+}
+
+// AddKey adds the passed private key to the ring and returns its
+// pay-to-pubkey-hash address. Outputs paying to the compressed public key
+// directly are unlocked as well.
+func (r *KeyRing) AddKey(key *secp256k1.PrivateKey) (dcrutil.Address, error) {
+	if _, err := r.AddKeyAddress(key, P2PKAddress); err != nil {
+		return nil, err
+	}
+	return r.AddKeyAddress(key, P2PKHAddress)
+}
+
+// AddKeyAddress adds the key of the signature suite of the passed address type
+// derived from the private key to the ring and returns the address of the type.
+// The redeem script of a P2SHAddress is added along with the key it requires.
+func (r *KeyRing) AddKeyAddress(key *secp256k1.PrivateKey, addrType AddressType) (dcrutil.Address, error) {
+	if addrType == P2SHAddress {
+		if _, err := r.AddKeyAddress(key, P2PKAddress); err != nil {
+			return nil, err
+		}
+		redeemScript, err := keyRedeemScript(key)
+		if err != nil {
+			return nil, err
+		}
+		return r.AddScript(redeemScript)
+	}
+	addr, suiteKey, err := keyAddress(key, addrType, r.net)
+	if err != nil {
+		return nil, err
+	}
+	r.keys[addr.String()] = suiteKey
+	return addr, nil
+}
+
+// AddKeyAddresses adds the passed private key to the ring for every
+// AddressType, so outputs paying to any address derived from the key are
+// unlocked.
+func (r *KeyRing) AddKeyAddresses(key *secp256k1.PrivateKey) error {
+	for _, addrType := range AddressTypes {
+		if _, err := r.AddKeyAddress(key, addrType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddScript adds the passed redeem script to the ring and returns its
+// pay-to-script-hash address. The keys required by the script have to be added
+// with AddKey.
+func (r *KeyRing) AddScript(redeemScript []byte) (dcrutil.Address, error) {
+	addr, err := dcrutil.NewAddressScriptHash(redeemScript, r.net)
+	if err != nil {
+		return nil, err
+	}
+	r.scripts[addr.String()] = redeemScript
+	return addr, nil
+}
+
+// GetKey implements txscript.KeyDB.
+func (r *KeyRing) GetKey(addr dcrutil.Address) (chainec.PrivateKey, bool, error) {
+	key, ok := r.keys[addr.String()]
+	if !ok {
+		return nil, false, fmt.Errorf("no key for address %v", addr)
+	}
+	return key, true, nil
+}
+
+// GetScript implements txscript.ScriptDB.
+func (r *KeyRing) GetScript(addr dcrutil.Address) ([]byte, error) {
+	script, ok := r.scripts[addr.String()]
+	if !ok {
+		return nil, fmt.Errorf("no redeem script for address %v", addr)
+	}
+	return script, nil
+}
+
+// SignInput signs the input at the passed index of the transaction spending an
+// output with the passed public key script.
+// Inputs spending anyone-can-spend OP_TRUE outputs are left with an empty
+// signature script.
+func (r *KeyRing) SignInput(tx *wire.MsgTx, index int, pkScript []byte) error {
+	if bytes.Equal(pkScript, opTrueScript) {
+		return nil
+	}
+	sigScript, err := txscript.SignTxOutput(r.net, tx, index, pkScript,
+		txscript.SigHashAll, r, r, tx.TxIn[index].SignatureScript,
+		r.signatureType(pkScript))
+	if err != nil {
+		return err
+	}
+	tx.TxIn[index].SignatureScript = sigScript
+	return nil
+}
+
+// signatureType returns the signature suite of the address the passed public
+// key script pays to, looking into the redeem script of pay-to-script-hash
+// outputs.
+func (r *KeyRing) signatureType(pkScript []byte) dcrec.SignatureType {
+	class, addrs, _, err := txscript.ExtractPkScriptAddrs(
+		txscript.DefaultScriptVersion, pkScript, r.net)
+	if err != nil || len(addrs) == 0 {
+		return dcrec.STEcdsaSecp256k1
+	}
+	if class == txscript.ScriptHashTy {
+		redeemScript, ok := r.scripts[addrs[0].String()]
+		if !ok {
+			return dcrec.STEcdsaSecp256k1
+		}
+		return r.signatureType(redeemScript)
+	}
+	return addrs[0].DSA(r.net)
+}
+
+// SpendableOutput is a transaction output the harness is able to spend
+type SpendableOutput struct {
+	OutPoint wire.OutPoint
+	Value    int64
+	PkScript []byte
+
+	// BlockHeight and BlockIndex locate the transaction holding the output
+	// in the chain, they are committed to by the spending input
+	BlockHeight uint32
+	BlockIndex  uint32
+}
+
+// TxIn returns an unsigned input spending the output.
+func (o *SpendableOutput) TxIn() *wire.TxIn {
+	return &wire.TxIn{
+		PreviousOutPoint: o.OutPoint,
+		Sequence:         wire.MaxTxInSequenceNum,
+		ValueIn:          o.Value,
+		BlockHeight:      o.BlockHeight,
+		BlockIndex:       o.BlockIndex,
+	}
+}
+
+// HarnessOutPoint returns the outpoint of the output as a coinharness.OutPoint.
+func (o *SpendableOutput) HarnessOutPoint() coinharness.OutPoint {
+	return coinharness.OutPoint{
+		Hash:  o.OutPoint.Hash,
+		Index: o.OutPoint.Index,
+		Tree:  o.OutPoint.Tree,
+	}
+}
+
+// HarnessTxOut returns the output as a coinharness.TxOut.
+func (o *SpendableOutput) HarnessTxOut() *coinharness.TxOut {
+	return &coinharness.TxOut{
+		Value:    coin.Amount{AtomsValue: o.Value},
+		PkScript: o.PkScript,
+	}
+}
+
+// SpendOutputs creates a transaction spending the passed outputs to the passed
+// outputs and signs it with the keys of the ring. The difference between the
+// values spent and paid is the fee.
+func SpendOutputs(ring *KeyRing, prevOuts []*SpendableOutput, outputs []*wire.TxOut) (*wire.MsgTx, error) {
+	tx := wire.NewMsgTx()
+	for _, prevOut := range prevOuts {
+		tx.AddTxIn(prevOut.TxIn())
+	}
+	for _, txOut := range outputs {
+		tx.AddTxOut(txOut)
+	}
+	if err := signTxInputs(tx, prevOuts, ring); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// signTxInputs signs the inputs of the transaction spending the passed outputs.
+func signTxInputs(tx *wire.MsgTx, prevOuts []*SpendableOutput, ring *KeyRing) error {
+	for i, prevOut := range prevOuts {
+		tx.TxIn[i].SignatureScript = nil
+		if err := ring.SignInput(tx, i, prevOut.PkScript); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeriveAccountKey derives the private key at the BIP0044 path
+// m/44'/coinType'/account'/branch/index from the passed seed the way the
+// node's wallet does.
+func DeriveAccountKey(seed []byte, net *chaincfg.Params, coinType, account, branch, index uint32) (*secp256k1.PrivateKey, error) {
+	key, err := hdkeychain.NewMaster(seed, net)
+	if err != nil {
+		return nil, err
+	}
+	path := []uint32{
+		44 + hdkeychain.HardenedKeyStart,
+		coinType + hdkeychain.HardenedKeyStart,
+		account + hdkeychain.HardenedKeyStart,
+		branch,
+		index,
+	}
+	for _, child := range path {
+		key, err = key.Child(child)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return key.ECPrivKey()
+}
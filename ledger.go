@@ -0,0 +1,179 @@
+package btcharness
+
+import (
+	"fmt"
+
+	"github.com/jfixby/coinharness"
+	"github.com/picfight/pfcd/chaincfg"
+	"github.com/picfight/pfcd/dcrec/secp256k1"
+	"github.com/picfight/pfcd/dcrutil"
+	"github.com/picfight/pfcd/rpcclient"
+	"github.com/picfight/pfcd/txscript"
+	"github.com/picfight/pfcd/wire"
+)
+
+// WellKnownSeed returns the seed of the wallet owning the block one ledger and
+// the organization outputs of the simulation and regression test networks. A
+// new copy is returned on every call, so callers may modify it.
+func WellKnownSeed() []byte {
+	return make([]byte, 32)
+}
+
+// ledgerKeyScanLimit is the number of addresses of the external branch
+// scanned to recover the keys of a well-known ledger.
+const ledgerKeyScanLimit = 100
+
+// LedgerEntry is a block one ledger payout to a key controlled by the harness
+type LedgerEntry struct {
+	Key     *secp256k1.PrivateKey
+	Address dcrutil.Address
+	Amount  int64
+}
+
+// NewBlockOneLedger derives one key per passed amount from the seed, at the
+// external branch of the first account, and returns the ledger paying the
+// amounts to them.
+func NewBlockOneLedger(seed []byte, amounts []int64, net *chaincfg.Params) ([]*LedgerEntry, error) {
+	ledger := make([]*LedgerEntry, 0, len(amounts))
+	for i, amount := range amounts {
+		key, err := DeriveAccountKey(seed, net, net.LegacyCoinType, 0, 0,
+			uint32(i))
+		if err != nil {
+			return nil, err
+		}
+		addr, err := keyToAddr(key, net)
+		if err != nil {
+			return nil, err
+		}
+		ledger = append(ledger, &LedgerEntry{
+			Key:     key,
+			Address: addr,
+			Amount:  amount,
+		})
+	}
+	return ledger, nil
+}
+
+// WithBlockOneLedger returns a copy of the passed network parameters paying
+// the passed ledger in block one. Since the ledger is a consensus rule, the
+// chain has to be validated with the same parameters. The node has its network
+// parameters compiled in, so the returned parameters only work with chains
+// fabricated offline with ChainBuilder and validated in process; a node rejects
+// block one of such a chain, and BlockOneLedgerOutputs reports a block one
+// mined by the node not paying the ledger.
+func WithBlockOneLedger(net *chaincfg.Params, ledger []*LedgerEntry) *chaincfg.Params {
+	params := *net
+	params.BlockOneLedger = make([]*chaincfg.TokenPayout, len(ledger))
+	for i, entry := range ledger {
+		params.BlockOneLedger[i] = &chaincfg.TokenPayout{
+			Address: entry.Address.String(),
+			Amount:  entry.Amount,
+		}
+	}
+	return &params
+}
+
+// DefaultBlockOneLedger recovers the keys of the built-in block one ledger of
+// the passed network from the WellKnownSeed(). An error is returned for
+// networks whose ledger is not owned by the well-known wallet.
+func DefaultBlockOneLedger(net *chaincfg.Params) ([]*LedgerEntry, error) {
+	ledger := make([]*LedgerEntry, len(net.BlockOneLedger))
+	found := 0
+	for _, coinType := range []uint32{net.LegacyCoinType, net.SLIP0044CoinType} {
+		for i := uint32(0); i < ledgerKeyScanLimit; i++ {
+			key, err := DeriveAccountKey(WellKnownSeed(), net, coinType,
+				0, 0, i)
+			if err != nil {
+				return nil, err
+			}
+			addr, err := keyToAddr(key, net)
+			if err != nil {
+				return nil, err
+			}
+			for j, payout := range net.BlockOneLedger {
+				if ledger[j] == nil && payout.Address == addr.String() {
+					ledger[j] = &LedgerEntry{
+						Key:     key,
+						Address: addr,
+						Amount:  payout.Amount,
+					}
+					found++
+				}
+			}
+			if found == len(ledger) {
+				return ledger, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("block one ledger of %v is not owned by the "+
+		"well-known wallet", net.Name)
+}
+
+// LedgerKeyRing returns a KeyRing holding the keys of the passed ledger.
+func LedgerKeyRing(ledger []*LedgerEntry, net *chaincfg.Params) (*KeyRing, error) {
+	ring := NewKeyRing(net)
+	for _, entry := range ledger {
+		if _, err := ring.AddKey(entry.Key); err != nil {
+			return nil, err
+		}
+	}
+	return ring, nil
+}
+
+// BlockOneLedgerOutputs returns the outputs of the passed block one paying to
+// the passed ledger. The outputs are spendable once the coinbase maturity is
+// reached. An error is returned when an entry of the ledger is not paid, which
+// is the case for a block one built with other network parameters.
+func BlockOneLedgerOutputs(blockOne *dcrutil.Block, ledger []*LedgerEntry, net *chaincfg.Params) ([]*SpendableOutput, error) {
+	if blockOne.Height() != 1 {
+		return nil, fmt.Errorf("block %v is at height %v, expected 1",
+			blockOne.Hash(), blockOne.Height())
+	}
+	coinbaseTx := blockOne.Transactions()[0]
+	var outputs []*SpendableOutput
+	for _, entry := range ledger {
+		pkScript, err := txscript.PayToAddrScript(entry.Address)
+		if err != nil {
+			return nil, err
+		}
+		paid := false
+		for i, txOut := range coinbaseTx.MsgTx().TxOut {
+			if string(txOut.PkScript) != string(pkScript) ||
+				txOut.Value != entry.Amount {
+				continue
+			}
+			paid = true
+			outputs = append(outputs, &SpendableOutput{
+				OutPoint: *wire.NewOutPoint(coinbaseTx.Hash(),
+					uint32(i), wire.TxTreeRegular),
+				Value:       txOut.Value,
+				PkScript:    txOut.PkScript,
+				BlockHeight: 1,
+				BlockIndex:  0,
+			})
+		}
+		if !paid {
+			return nil, fmt.Errorf("block %v does not pay %v to %v, "+
+				"the ledger does not match the block one ledger of %v",
+				blockOne.Hash(), dcrutil.Amount(entry.Amount),
+				entry.Address, net.Name)
+		}
+	}
+	return outputs, nil
+}
+
+// FetchBlockOneLedgerOutputs fetches block one from the node and returns its
+// outputs paying to the passed ledger.
+func FetchBlockOneLedgerOutputs(client coinharness.RPCClient, ledger []*LedgerEntry, net *chaincfg.Params) ([]*SpendableOutput, error) {
+	rpc := client.Internal().(*rpcclient.Client)
+
+	hash, err := rpc.GetBlockHash(1)
+	if err != nil {
+		return nil, err
+	}
+	mBlock, err := rpc.GetBlock(hash)
+	if err != nil {
+		return nil, err
+	}
+	return BlockOneLedgerOutputs(dcrutil.NewBlock(mBlock), ledger, net)
+}
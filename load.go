@@ -0,0 +1,450 @@
+package btcharness
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jfixby/coin"
+	"github.com/jfixby/coinharness"
+	"github.com/jfixby/pin"
+	"github.com/picfight/pfcd/chaincfg/chainhash"
+	"github.com/picfight/pfcd/dcrjson"
+	"github.com/picfight/pfcd/dcrutil"
+	"github.com/picfight/pfcd/rpcclient"
+	"github.com/picfight/pfcd/txscript"
+	"github.com/picfight/pfcd/wire"
+)
+
+const (
+	// maxSplitOutputs is the number of outputs of a transaction created by
+	// SplitFunds()
+	maxSplitOutputs = 100
+
+	// splitFeeReserve is the value kept by SplitFunds() to pay the fee of
+	// a transaction of maxSplitOutputs outputs
+	splitFeeReserve = int64(DefaultMinRelayTxFee) * 5
+
+	// defaultSampleInterval is the interval GenerateLoad() samples the
+	// mempool size at unless LoadArgs.SampleInterval is set
+	defaultSampleInterval = 100 * time.Millisecond
+
+	// propagationPollInterval is the interval MeasureBlockPropagation()
+	// polls the best block of the peers at
+	propagationPollInterval = 10 * time.Millisecond
+)
+
+// hashPattern matches the hashes in rejection messages, so the rejections of
+// different transactions for the same reason are counted together.
+var hashPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// SplitFundsArgs bundles SplitFunds() arguments to minimize diff
+// in case a new argument for the function is added
+type SplitFundsArgs struct {
+	// Inputs are the outputs to split, for example the ones returned by
+	// FetchMemWalletOutputs()
+	Inputs  []*SpendableOutput
+	KeyRing *KeyRing
+
+	// PayTo receives the split outputs and the change, its key has to be
+	// in the KeyRing to spend them
+	PayTo dcrutil.Address
+
+	// Count is the number of outputs of the passed Value to create
+	Count int
+	Value int64
+
+	Network coinharness.Network
+}
+
+// SplitFunds splits the inputs into args.Count outputs of args.Value, sends the
+// splitting transactions to the node and mines them with the node's miner.
+// The change of a splitting transaction funds the next one. An error is
+// returned unless all the splitting transactions are mined, the returned
+// outputs carry the location of their transactions in the chain.
+func SplitFunds(client coinharness.RPCClient, args *SplitFundsArgs) ([]*SpendableOutput, error) {
+	pin.AssertTrue("args.Count is not positive", args.Count > 0)
+	pin.AssertTrue("args.Value is not positive", args.Value > 0)
+
+	rpc := client.Internal().(*rpcclient.Client)
+	pkScript, err := txscript.PayToAddrScript(args.PayTo)
+	if err != nil {
+		return nil, err
+	}
+	changeAddr := &Address{Address: args.PayTo}
+
+	queue := append([]*SpendableOutput(nil), args.Inputs...)
+	var outputs []*SpendableOutput
+	var splitTxns []*chainhash.Hash
+	for len(outputs) < args.Count && len(queue) > 0 {
+		input := queue[0]
+		queue = queue[1:]
+
+		n := (input.Value - splitFeeReserve) / args.Value
+		if remaining := int64(args.Count - len(outputs)); n > remaining {
+			n = remaining
+		}
+		if n > maxSplitOutputs {
+			n = maxSplitOutputs
+		}
+		if n <= 0 {
+			continue
+		}
+
+		builder := NewTxBuilder(args.Network).
+			SignWithKeyRing(args.KeyRing).
+			AddSpendableOutput(input).
+			ChangeAddress(changeAddr)
+		for i := int64(0); i < n; i++ {
+			builder.PayToScript(pkScript, coin.Amount{AtomsValue: args.Value})
+		}
+		built, err := builder.Build()
+		if err != nil {
+			return nil, err
+		}
+		tx, err := TransactionTxToRawErr(built.Tx)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := rpc.SendRawTransaction(tx, true); err != nil {
+			return nil, err
+		}
+		hash := tx.TxHash()
+		splitTxns = append(splitTxns, &hash)
+
+		for i, txOut := range tx.TxOut {
+			output := &SpendableOutput{
+				OutPoint: *wire.NewOutPoint(&hash, uint32(i),
+					wire.TxTreeRegular),
+				Value:       txOut.Value,
+				PkScript:    txOut.PkScript,
+				BlockHeight: wire.NullBlockHeight,
+				BlockIndex:  wire.NullBlockIndex,
+			}
+			if i == built.ChangeIndex {
+				queue = append([]*SpendableOutput{output}, queue...)
+				continue
+			}
+			outputs = append(outputs, output)
+		}
+	}
+	if len(outputs) < args.Count {
+		return nil, fmt.Errorf("inputs fund %v outputs of %v, %v requested",
+			len(outputs), dcrutil.Amount(args.Value), args.Count)
+	}
+
+	if _, err := rpc.Generate(1); err != nil {
+		return nil, err
+	}
+	// Locate the mined split transactions, the inputs spending the
+	// outputs commit to their location.
+	type location struct {
+		blockHeight uint32
+		blockIndex  uint32
+	}
+	locations := make(map[chainhash.Hash]location, len(splitTxns))
+	for _, hash := range splitTxns {
+		tx, err := rpc.GetRawTransactionVerbose(hash)
+		if err != nil {
+			return nil, err
+		}
+		if tx.Confirmations <= 0 {
+			return nil, fmt.Errorf("split transaction %v was not mined",
+				hash)
+		}
+		locations[*hash] = location{
+			blockHeight: uint32(tx.BlockHeight),
+			blockIndex:  tx.BlockIndex,
+		}
+	}
+	for _, output := range outputs {
+		loc := locations[output.OutPoint.Hash]
+		output.BlockHeight = loc.blockHeight
+		output.BlockIndex = loc.blockIndex
+	}
+	return outputs, nil
+}
+
+// LoadArgs bundles GenerateLoad() arguments to minimize diff
+// in case a new argument for the function is added
+type LoadArgs struct {
+	// Outputs are spent by one transaction each, for example the ones
+	// returned by SplitFunds()
+	Outputs []*SpendableOutput
+	KeyRing *KeyRing
+	PayTo   dcrutil.Address
+
+	// Fee paid by each transaction, zero means DefaultMinRelayTxFee for the
+	// size of the transaction
+	Fee int64
+
+	// Rate is the target number of transactions sent per second,
+	// zero means as fast as the workers send them
+	Rate float64
+
+	// Workers is the number of concurrent senders,
+	// zero means the number of CPUs
+	Workers int
+
+	// SampleInterval is the interval the mempool size is sampled at,
+	// zero means 100ms
+	SampleInterval time.Duration
+}
+
+// MempoolSample is the size of the node's mempool during GenerateLoad()
+type MempoolSample struct {
+	// Elapsed is the time since the first transaction was sent
+	Elapsed time.Duration
+	Size    int
+}
+
+// LoadReport reports the outcome of GenerateLoad()
+type LoadReport struct {
+	Sent     int
+	Accepted int
+
+	// Elapsed is the time between sending the first transaction and the
+	// reply to the last one
+	Elapsed time.Duration
+
+	// Latencies are the round trip times of the accepted transactions,
+	// in ascending order
+	Latencies []time.Duration
+
+	// Rejects counts the rejected transactions by reason
+	Rejects map[string]int
+
+	Mempool []MempoolSample
+}
+
+// Throughput returns the number of transactions accepted per second.
+func (r *LoadReport) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Accepted) / r.Elapsed.Seconds()
+}
+
+// LatencyPercentile returns the acceptance latency within which the passed
+// percentage of the accepted transactions fall, by the nearest-rank method.
+// Zero is returned when none was accepted.
+func (r *LoadReport) LatencyPercentile(percent float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	index := int(math.Ceil(percent/100*float64(len(r.Latencies)))) - 1
+	if index >= len(r.Latencies) {
+		index = len(r.Latencies) - 1
+	}
+	if index < 0 {
+		index = 0
+	}
+	return r.Latencies[index]
+}
+
+// loadResult is the outcome of sending a transaction
+type loadResult struct {
+	latency time.Duration
+	err     error
+}
+
+// GenerateLoad signs one transaction per output of args and then sends them to
+// the node concurrently at the target rate, sampling the mempool size while the
+// load lasts. Rejections are reported and are not errors.
+func GenerateLoad(client coinharness.RPCClient, args *LoadArgs) (*LoadReport, error) {
+	rpc := client.Internal().(*rpcclient.Client)
+	workers := args.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	sampleInterval := args.SampleInterval
+	if sampleInterval <= 0 {
+		sampleInterval = defaultSampleInterval
+	}
+	pkScript, err := txscript.PayToAddrScript(args.PayTo)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sign everything upfront, so only the node is measured.
+	txns := make([]*wire.MsgTx, len(args.Outputs))
+	for i, output := range args.Outputs {
+		txns[i], _, err = splitOutput(args.KeyRing, output, pkScript, 1,
+			args.Fee, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	start := time.Now()
+	done := make(chan struct{})
+	var samples []MempoolSample
+	var sampleErr error
+	var sampler sync.WaitGroup
+	sampler.Add(1)
+	go func() {
+		defer sampler.Done()
+		ticker := time.NewTicker(sampleInterval)
+		defer ticker.Stop()
+		for {
+			pool, err := rpc.GetRawMempool(dcrjson.GRMAll)
+			if err != nil {
+				sampleErr = err
+				return
+			}
+			samples = append(samples, MempoolSample{
+				Elapsed: time.Since(start),
+				Size:    len(pool),
+			})
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	queue := make(chan *wire.MsgTx)
+	results := make(chan loadResult, len(txns))
+	var senders sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+			for tx := range queue {
+				sent := time.Now()
+				_, err := rpc.SendRawTransaction(tx, true)
+				results <- loadResult{
+					latency: time.Since(sent),
+					err:     err,
+				}
+			}
+		}()
+	}
+
+	var throttle <-chan time.Time
+	if args.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) /
+			args.Rate))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+	for _, tx := range txns {
+		if throttle != nil {
+			<-throttle
+		}
+		queue <- tx
+	}
+	close(queue)
+	senders.Wait()
+	elapsed := time.Since(start)
+	close(done)
+	sampler.Wait()
+	close(results)
+
+	report := &LoadReport{
+		Sent:    len(txns),
+		Elapsed: elapsed,
+		Rejects: make(map[string]int),
+		Mempool: samples,
+	}
+	for result := range results {
+		if result.err != nil {
+			report.Rejects[rejectReason(result.err)]++
+			continue
+		}
+		report.Accepted++
+		report.Latencies = append(report.Latencies, result.latency)
+	}
+	sort.Slice(report.Latencies, func(i, j int) bool {
+		return report.Latencies[i] < report.Latencies[j]
+	})
+	if sampleErr != nil {
+		return report, sampleErr
+	}
+	return report, nil
+}
+
+// rejectReason returns the reason of the passed rejection with the hashes
+// masked out.
+func rejectReason(err error) string {
+	msg := err.Error()
+	if rpcErr, ok := err.(*dcrjson.RPCError); ok {
+		msg = rpcErr.Message
+	}
+	return hashPattern.ReplaceAllString(msg, "<hash>")
+}
+
+// PropagationReport reports the outcome of MeasureBlockPropagation()
+type PropagationReport struct {
+	Block *chainhash.Hash
+
+	// Transactions is the number of regular transactions of the block,
+	// including the coinbase
+	Transactions int
+
+	// Delays are the times the peers took to make the block their best
+	// block after the miner mined it, in the order of the peers
+	Delays []time.Duration
+}
+
+// MeasureBlockPropagation mines a block with the miner's node and measures how
+// long each of the peers takes to make it its best block. An error is returned
+// when a peer does not reach the block within the timeout.
+func MeasureBlockPropagation(miner coinharness.RPCClient, peers []coinharness.RPCClient, timeout time.Duration) (*PropagationReport, error) {
+	rpc := miner.Internal().(*rpcclient.Client)
+
+	hashes, err := rpc.Generate(1)
+	if err != nil {
+		return nil, err
+	}
+	mined := time.Now()
+	hash := hashes[0]
+
+	delays := make([]time.Duration, len(peers))
+	errs := make([]error, len(peers))
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		wg.Add(1)
+		go func(i int, peer *rpcclient.Client) {
+			defer wg.Done()
+			for {
+				best, _, err := peer.GetBestBlock()
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				if *best == *hash {
+					delays[i] = time.Since(mined)
+					return
+				}
+				if time.Since(mined) > timeout {
+					errs[i] = fmt.Errorf("peer %v did not reach "+
+						"block %v within %v", i, hash, timeout)
+					return
+				}
+				time.Sleep(propagationPollInterval)
+			}
+		}(i, peer.Internal().(*rpcclient.Client))
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	block, err := rpc.GetBlock(hash)
+	if err != nil {
+		return nil, err
+	}
+	return &PropagationReport{
+		Block:        hash,
+		Transactions: len(block.Transactions),
+		Delays:       delays,
+	}, nil
+}
@@ -0,0 +1,44 @@
+package btcharness
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/picfight/pfcd/wire"
+)
+
+// MedianTimeBlocks is the number of previous blocks which are used to
+// calculate the median time used to validate block timestamps.
+const MedianTimeBlocks = 11
+
+// CalcPastMedianTime calculates the median time of the previous few blocks
+// prior to, and including, the last of the passed headers. The headers must be
+// ordered by height and either reach back to the genesis block or contain at
+// least MedianTimeBlocks entries.
+func CalcPastMedianTime(headers []*wire.BlockHeader) (time.Time, error) {
+	numNodes := len(headers)
+	if numNodes > MedianTimeBlocks {
+		headers = headers[numNodes-MedianTimeBlocks:]
+		numNodes = MedianTimeBlocks
+	}
+	if numNodes == 0 ||
+		numNodes < MedianTimeBlocks && headers[0].Height != 0 {
+		return time.Time{}, fmt.Errorf("not enough headers to calculate "+
+			"median time: got %v, need %v", numNodes, MedianTimeBlocks)
+	}
+
+	timestamps := make([]int64, numNodes)
+	for i, header := range headers {
+		timestamps[i] = header.Timestamp.Unix()
+	}
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] < timestamps[j]
+	})
+
+	// NOTE: The consensus rules incorrectly calculate the median for even
+	// numbers of blocks. This code follows suit to ensure the same rules
+	// are used.
+	medianTimestamp := timestamps[numNodes/2]
+	return time.Unix(medianTimestamp, 0), nil
+}
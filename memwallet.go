@@ -1,6 +1,8 @@
 package btcharness
 
 import (
+	"encoding/hex"
+
 	"github.com/jfixby/coinharness"
 	"github.com/jfixby/pin"
 	"github.com/picfight/pfcd/blockchain"
@@ -8,11 +10,15 @@ import (
 	"github.com/picfight/pfcd/dcrec/secp256k1"
 	"github.com/picfight/pfcd/dcrutil"
 	"github.com/picfight/pfcd/hdkeychain"
+	"github.com/picfight/pfcd/rpcclient"
 	"github.com/picfight/pfcd/wire"
 )
 
 // InMemoryWalletFactory produces a new InMemoryWallet-instance upon request
 type InMemoryWalletFactory struct {
+	// AddressType is the type of the addresses returned by NewAddress()
+	// of the wallets, the coinbase address is always a P2PKHAddress
+	AddressType AddressType
 }
 
 // NewWallet creates and returns a fully initialized instance of the InMemoryWallet.
@@ -54,7 +60,7 @@ func (f *InMemoryWalletFactory) NewWallet(cfg *coinharness.TestWalletConfig) coi
 		ChainUpdateSignal:   make(chan string),
 		ReorgJournal:        make(map[int64]*coinharness.UndoEntry),
 		RPCClientFactory:    clientFac,
-		PrivateKeyKeyToAddr: PrivateKeyKeyToAddr,
+		PrivateKeyKeyToAddr: KeyToAddrFunc(f.AddressType),
 		ReadBlockHeader:     ReadBlockHeader,
 		NewTxFromBytes:      NewTxFromBytes,
 		IsCoinBaseTx:        IsCoinBaseTx,
@@ -110,3 +116,74 @@ func ReadBlockHeader(header []byte) coinharness.BlockHeader {
 	}
 	return &BlockHeader{legacy: hdr}
 }
+
+// MemWalletKeyRing returns a KeyRing holding the keys of every address the
+// passed InMemoryWallet has generated so far, including the coinbase address.
+// The keys unlock the outputs paying to any AddressType derived from them.
+func MemWalletKeyRing(wallet *coinharness.InMemoryWallet) (*KeyRing, error) {
+	wallet.RLock()
+	defer wallet.RUnlock()
+
+	ring := NewKeyRing(wallet.Net.Params().(*chaincfg.Params))
+	for index := uint32(0); index < wallet.HdIndex; index++ {
+		child, err := wallet.HdRoot.Child(index)
+		if err != nil {
+			return nil, err
+		}
+		key, err := child.PrivateKey()
+		if err != nil {
+			return nil, err
+		}
+		if err := ring.AddKeyAddresses(key.(*PrivateKey).legacy); err != nil {
+			return nil, err
+		}
+	}
+	return ring, nil
+}
+
+// FetchMemWalletOutputs returns the unspent outputs of the passed
+// InMemoryWallet the node considers spendable in the next block. Their values
+// and scripts are fetched from the node, the fraud proofs are left null.
+func FetchMemWalletOutputs(wallet *coinharness.InMemoryWallet, client coinharness.RPCClient) ([]*SpendableOutput, error) {
+	rpc := client.Internal().(*rpcclient.Client)
+	maturity := wallet.Net.CoinbaseMaturity()
+
+	wallet.RLock()
+	outPoints := make([]coinharness.OutPoint, 0, len(wallet.Utxos))
+	for outPoint := range wallet.Utxos {
+		outPoints = append(outPoints, outPoint)
+	}
+	wallet.RUnlock()
+
+	var outputs []*SpendableOutput
+	for _, outPoint := range outPoints {
+		hash, err := HashToRaw(outPoint.Hash)
+		if err != nil {
+			return nil, err
+		}
+		txOut, err := rpc.GetTxOut(&hash, outPoint.Index, false)
+		if err != nil {
+			return nil, err
+		}
+		if txOut == nil || txOut.Coinbase && txOut.Confirmations < maturity {
+			continue
+		}
+		value, err := dcrutil.NewAmount(txOut.Value)
+		if err != nil {
+			return nil, err
+		}
+		pkScript, err := hex.DecodeString(txOut.ScriptPubKey.Hex)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, &SpendableOutput{
+			OutPoint: *wire.NewOutPoint(&hash, outPoint.Index,
+				outPoint.Tree),
+			Value:       int64(value),
+			PkScript:    pkScript,
+			BlockHeight: wire.NullBlockHeight,
+			BlockIndex:  wire.NullBlockIndex,
+		})
+	}
+	return outputs, nil
+}
@@ -0,0 +1,140 @@
+package btcharness
+
+import (
+	"fmt"
+	"github.com/jfixby/coinharness"
+	"github.com/jfixby/pin"
+	"github.com/picfight/pfcd/chaincfg/chainhash"
+	"github.com/picfight/pfcd/dcrutil"
+	"github.com/picfight/pfcd/rpcclient"
+)
+
+// ReorgArgs bundles GenerateReorg() arguments to minimize diff
+// in case a new argument for the function is added
+type ReorgArgs struct {
+	// ForkPoint is the hash of the ancestor block the side chain builds on
+	ForkPoint *chainhash.Hash
+
+	// Blocks describes the side chain, one entry per block to be built on
+	// top of the ForkPoint. Each entry is passed to CreateBlock as is.
+	Blocks []*GenerateBlockArgs
+}
+
+// ReorgResult reports the chain state before and after GenerateReorg()
+type ReorgResult struct {
+	// Blocks are the side chain blocks in the order they were submitted
+	Blocks []*dcrutil.Block
+
+	OldTip       *chainhash.Hash
+	OldTipHeight int64
+
+	NewTip       *chainhash.Hash
+	NewTipHeight int64
+
+	// ForkHeight is the height of the last block shared by the former
+	// main chain and the side chain
+	ForkHeight int64
+
+	// Reorganized is true when the node switched its main chain to the
+	// submitted side chain
+	Reorganized bool
+
+	// Depth is the number of blocks disconnected from the former main chain
+	Depth int64
+}
+
+// GenerateReorg builds a side chain of len(args.Blocks) blocks off the
+// args.ForkPoint ancestor, submits every block to the node and reports
+// whether and how deep the node reorganized. When the ForkPoint is the current
+// tip the side chain simply extends the main chain and no reorg is reported.
+func GenerateReorg(client coinharness.RPCClient, args *ReorgArgs) (*ReorgResult, error) {
+	pin.AssertNotNil("args.ForkPoint", args.ForkPoint)
+	pin.AssertTrue("args.Blocks is empty", len(args.Blocks) > 0)
+
+	rpc := client.Internal().(*rpcclient.Client)
+
+	oldTip, oldTipHeight, err := rpc.GetBestBlock()
+	if err != nil {
+		return nil, err
+	}
+	forkHeight, err := mainChainAncestorHeight(rpc, args.ForkPoint)
+	if err != nil {
+		return nil, err
+	}
+
+	mBlock, err := rpc.GetBlock(args.ForkPoint)
+	if err != nil {
+		return nil, err
+	}
+	prevBlock := dcrutil.NewBlock(mBlock)
+
+	result := &ReorgResult{
+		OldTip:       oldTip,
+		OldTipHeight: oldTipHeight,
+		ForkHeight:   forkHeight,
+	}
+	for i, blockArgs := range args.Blocks {
+		if blockArgs.RetargetDifficulty && blockArgs.Bits == 0 &&
+			blockArgs.PrevHeaders == nil {
+			prevHeaders, err := FetchDifficultyHeaders(client,
+				prevBlock.Hash(), blockArgs.Network)
+			if err != nil {
+				return result, err
+			}
+			withHeaders := *blockArgs
+			withHeaders.PrevHeaders = prevHeaders
+			blockArgs = &withHeaders
+		}
+		newBlock, err := CreateBlockWithArgs(prevBlock, blockArgs)
+		if err != nil {
+			return result, err
+		}
+		if err := rpc.SubmitBlock(newBlock, nil); err != nil {
+			return result, fmt.Errorf("side chain block %v (%v) rejected: %v",
+				i, newBlock.Hash(), err)
+		}
+		result.Blocks = append(result.Blocks, newBlock)
+		prevBlock = newBlock
+	}
+
+	result.NewTip, result.NewTipHeight, err = rpc.GetBestBlock()
+	if err != nil {
+		return result, err
+	}
+
+	// The former tip is still on the main chain unless a block at its
+	// height has been replaced.
+	if result.NewTipHeight >= oldTipHeight {
+		hash, err := rpc.GetBlockHash(oldTipHeight)
+		if err != nil {
+			return result, err
+		}
+		result.Reorganized = *hash != *oldTip
+	} else {
+		result.Reorganized = true
+	}
+	if result.Reorganized {
+		result.Depth = oldTipHeight - forkHeight
+	}
+	return result, nil
+}
+
+// mainChainAncestorHeight walks back from the passed block until it reaches a
+// block on the node's current main chain and returns the height of that block.
+func mainChainAncestorHeight(rpc *rpcclient.Client, hash *chainhash.Hash) (int64, error) {
+	for {
+		header, err := rpc.GetBlockHeader(hash)
+		if err != nil {
+			return 0, err
+		}
+		height := int64(header.Height)
+		mainHash, err := rpc.GetBlockHash(height)
+		if err != nil {
+			return 0, err
+		}
+		if *mainHash == *hash {
+			return height, nil
+		}
+		hash = &header.PrevBlock
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/picfight/pfcd/dcrutil"
 	"github.com/picfight/pfcd/rpcclient"
 	"io/ioutil"
+	"time"
 )
 
 type RPCClientFactory struct {
@@ -19,7 +20,6 @@ func (f *RPCClientFactory) NewRPCConnection(config coinharness.RPCConnectionConf
 	h := ConvertHandlers(handlers)
 
 	file := config.CertificateFile
-	fmt.Println("reading: " + file)
 	cert, err := ioutil.ReadFile(file)
 	pin.CheckTestSetupMalfunction(err)
 
@@ -270,8 +270,14 @@ func (c *RPCClient) Internal() interface{} {
 	return c.rpc
 }
 
+// GetRawMempool returns the hashes of the mempool transactions, the command is
+// either a MempoolTxType or a dcrjson.GetRawMempoolTxTypeCmd.
 func (c *RPCClient) GetRawMempool(command interface{}) (result []coinharness.Hash, e error) {
-	list, e := c.rpc.GetRawMempool(command.(dcrjson.GetRawMempoolTxTypeCmd))
+	txType, ok := command.(MempoolTxType)
+	if !ok {
+		txType = MempoolTxType(command.(dcrjson.GetRawMempoolTxTypeCmd))
+	}
+	list, e := c.GetMempool(txType)
 	if e != nil {
 		return nil, e
 	}
@@ -281,30 +287,116 @@ func (c *RPCClient) GetRawMempool(command interface{}) (result []coinharness.Has
 	return result, nil
 }
 
+// GetMempool returns the hashes of the mempool transactions of the passed type.
+func (c *RPCClient) GetMempool(txType MempoolTxType) ([]*chainhash.Hash, error) {
+	return c.rpc.GetRawMempool(dcrjson.GetRawMempoolTxTypeCmd(txType))
+}
+
+// GetMempoolVerbose returns the mempool transactions of the passed type along
+// with the state the node keeps for them.
+func (c *RPCClient) GetMempoolVerbose(txType MempoolTxType) (map[chainhash.Hash]*MempoolEntry, error) {
+	verbose, err := c.rpc.GetRawMempoolVerbose(
+		dcrjson.GetRawMempoolTxTypeCmd(txType))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[chainhash.Hash]*MempoolEntry, len(verbose))
+	for hashStr, v := range verbose {
+		hash, err := chainhash.NewHashFromStr(hashStr)
+		if err != nil {
+			return nil, err
+		}
+		fee, err := dcrutil.NewAmount(v.Fee)
+		if err != nil {
+			return nil, err
+		}
+		entry := &MempoolEntry{
+			Size:             v.Size,
+			Fee:              coin.Amount{AtomsValue: int64(fee)},
+			Time:             time.Unix(v.Time, 0),
+			Height:           v.Height,
+			StartingPriority: v.StartingPriority,
+			CurrentPriority:  v.CurrentPriority,
+		}
+		for _, dependStr := range v.Depends {
+			depend, err := chainhash.NewHashFromStr(dependStr)
+			if err != nil {
+				return nil, err
+			}
+			entry.Depends = append(entry.Depends, depend)
+		}
+		result[*hash] = entry
+	}
+	return result, nil
+}
+
 func (c *RPCClient) SendRawTransaction(tx *coinharness.MessageTx, allowHighFees bool) (result coinharness.Hash, e error) {
-	txx := TransactionTxToRaw(tx)
+	txx, e := TransactionTxToRawErr(tx)
+	if e != nil {
+		return nil, e
+	}
 	r, e := c.rpc.SendRawTransaction(txx, allowHighFees)
 	return r, e
 }
 
+// GetBlock returns the regular transactions of the block, GetFullBlock
+// returns the complete block.
 func (c *RPCClient) GetBlock(hash coinharness.Hash) (*coinharness.MsgBlock, error) {
-	block, err := c.rpc.GetBlock(hash.(*chainhash.Hash)) //*wire.MsgBlock
+	block, err := c.GetFullBlock(hash)
 	if err != nil {
 		return nil, err
 	}
 
 	b := &coinharness.MsgBlock{}
+	b.Transactions = block.Transactions
+
+	return b, nil
+}
 
-	ttx := []*coinharness.MessageTx{}
-	for _, ti := range block.Transactions {
-		ttx = append(ttx,
-			TransactionRawToTx(ti),
-		)
+// GetFullBlock returns the block with its header and both transaction trees.
+func (c *RPCClient) GetFullBlock(hash coinharness.Hash) (*MsgBlock, error) {
+	h, err := HashToRaw(hash)
+	if err != nil {
+		return nil, err
+	}
+	block, err := c.rpc.GetBlock(&h) //*wire.MsgBlock
+	if err != nil {
+		return nil, err
 	}
+	return BlockRawToBlock(block), nil
+}
 
-	b.Transactions = ttx
+// GetBlockVerbose returns the block along with its confirmations, the hash of
+// the next block and its size.
+func (c *RPCClient) GetBlockVerbose(hash coinharness.Hash) (*BlockVerbose, error) {
+	h, err := HashToRaw(hash)
+	if err != nil {
+		return nil, err
+	}
+	verbose, err := c.rpc.GetBlockVerbose(&h, false)
+	if err != nil {
+		return nil, err
+	}
+	block, err := c.GetFullBlock(&h)
+	if err != nil {
+		return nil, err
+	}
 
-	return b, nil
+	result := &BlockVerbose{
+		Block:         block,
+		Confirmations: verbose.Confirmations,
+		Size:          verbose.Size,
+		Difficulty:    verbose.Difficulty,
+		ChainWork:     verbose.ChainWork,
+	}
+	if verbose.NextHash != "" {
+		result.NextHash, err = chainhash.NewHashFromStr(verbose.NextHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
 }
 
 func (c *RPCClient) GetPeerInfo() ([]coinharness.PeerInfo, error) {
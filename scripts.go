@@ -0,0 +1,224 @@
+package btcharness
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/jfixby/coinharness"
+	"github.com/picfight/pfcd/chaincfg"
+	"github.com/picfight/pfcd/dcrutil"
+	"github.com/picfight/pfcd/txscript"
+)
+
+// The templates below produce the redeem scripts of custom output conditions.
+// Apart from the multisig script, the node's relay policy only accepts them
+// wrapped in a pay-to-script-hash output, see PayToScriptHashScript().
+//
+// OP_CHECKLOCKTIMEVERIFY is enforced from the start of the chain, while
+// OP_CHECKSEQUENCEVERIFY and OP_SHA256 are enforced by the consensus rules once
+// the lnfeatures agenda is active. The relay policy enforces
+// OP_CHECKSEQUENCEVERIFY regardless.
+
+// ScriptSigner builds the signature script of the input at the passed index of
+// the transaction, see TxBuilder.AddScriptInput()
+type ScriptSigner func(tx *coinharness.MessageTx, index int) ([]byte, error)
+
+// serializePubKey returns the compressed serialization of the passed harness
+// public key.
+func serializePubKey(pubKey coinharness.PublicKey) ([]byte, error) {
+	switch k := pubKey.(type) {
+	case PublicKey:
+		return k.SerializeCompressed(), nil
+	case *PublicKey:
+		return k.SerializeCompressed(), nil
+	}
+	return nil, fmt.Errorf("unsupported public key type %T", pubKey)
+}
+
+// MultiSigScript returns the script requiring nRequired signatures of the
+// passed public keys. The script is standard both as a bare output script and
+// as a redeem script.
+func MultiSigScript(nRequired int, pubKeys []coinharness.PublicKey, net coinharness.Network) ([]byte, error) {
+	addrs := make([]*dcrutil.AddressSecpPubKey, len(pubKeys))
+	for i, pubKey := range pubKeys {
+		serialized, err := serializePubKey(pubKey)
+		if err != nil {
+			return nil, err
+		}
+		addrs[i], err = dcrutil.NewAddressSecpPubKey(serialized,
+			net.Params().(*chaincfg.Params))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return txscript.MultiSigScript(addrs, nRequired)
+}
+
+// ScriptHashAddress returns the pay-to-script-hash address of the passed
+// redeem script.
+func ScriptHashAddress(redeemScript []byte, net coinharness.Network) (coinharness.Address, error) {
+	addr, err := dcrutil.NewAddressScriptHash(redeemScript,
+		net.Params().(*chaincfg.Params))
+	if err != nil {
+		return nil, err
+	}
+	return &Address{Address: addr}, nil
+}
+
+// PayToScriptHashScript returns the output script paying to the hash of the
+// passed redeem script.
+func PayToScriptHashScript(redeemScript []byte) ([]byte, error) {
+	return txscript.PayToScriptHashScript(dcrutil.Hash160(redeemScript))
+}
+
+// NullDataScript returns the unspendable OP_RETURN output script carrying the
+// passed data. The relay policy accepts a single such output of at most
+// txscript.MaxDataCarrierSize bytes per transaction.
+func NullDataScript(data []byte) ([]byte, error) {
+	return txscript.NewScriptBuilder().AddOp(txscript.OP_RETURN).
+		AddData(data).Script()
+}
+
+// LockTimeScript returns the script locking the output until the passed
+// absolute lock time, a block height below txscript.LockTimeThreshold or a unix
+// time otherwise, and requiring a signature of the public key after it. The
+// spending transaction must set its lock time at or above the passed one and
+// the spending input must not be final.
+func LockTimeScript(lockTime uint32, pubKey coinharness.PublicKey) ([]byte, error) {
+	serialized, err := serializePubKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	return txscript.NewScriptBuilder().
+		AddInt64(int64(lockTime)).
+		AddOp(txscript.OP_CHECKLOCKTIMEVERIFY).
+		AddOp(txscript.OP_DROP).
+		AddData(serialized).
+		AddOp(txscript.OP_CHECKSIG).
+		Script()
+}
+
+// SequenceLockScript returns the script locking the output for the relative
+// lock time encoded in the passed sequence number, and requiring a signature
+// of the public key after it. The spending transaction must have version 2 or
+// later and the spending input must set a sequence number at or above the
+// passed one.
+func SequenceLockScript(sequence uint32, pubKey coinharness.PublicKey) ([]byte, error) {
+	serialized, err := serializePubKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	return txscript.NewScriptBuilder().
+		AddInt64(int64(sequence)).
+		AddOp(txscript.OP_CHECKSEQUENCEVERIFY).
+		AddOp(txscript.OP_DROP).
+		AddData(serialized).
+		AddOp(txscript.OP_CHECKSIG).
+		Script()
+}
+
+// HashLockScript returns the script requiring the preimage of the passed
+// SHA-256 hash and a signature of the public key.
+func HashLockScript(hash []byte, pubKey coinharness.PublicKey) ([]byte, error) {
+	if len(hash) != sha256.Size {
+		return nil, fmt.Errorf("hash must be %v bytes, got %v",
+			sha256.Size, len(hash))
+	}
+	serialized, err := serializePubKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	return txscript.NewScriptBuilder().
+		AddOp(txscript.OP_SHA256).
+		AddData(hash).
+		AddOp(txscript.OP_EQUALVERIFY).
+		AddData(serialized).
+		AddOp(txscript.OP_CHECKSIG).
+		Script()
+}
+
+// InputSignature returns the SigHashAll signature of the input at the passed
+// index of the transaction, committing to the passed script. The script is the
+// redeem script for pay-to-script-hash outputs and the output script
+// otherwise.
+func InputSignature(tx *coinharness.MessageTx, index int, script []byte, key coinharness.PrivateKey) ([]byte, error) {
+	wireTx, err := TransactionTxToRawErr(tx)
+	if err != nil {
+		return nil, err
+	}
+	return txscript.RawTxInSignature(wireTx, index, script,
+		txscript.SigHashAll, key.(*PrivateKey).legacy)
+}
+
+// MultiSigSpendScript returns the signature script of a multisig output from
+// the passed signatures, ordered like their public keys in the multisig
+// script. The redeem script is appended when spending a pay-to-script-hash
+// output and nil otherwise.
+func MultiSigSpendScript(sigs [][]byte, redeemScript []byte) ([]byte, error) {
+	builder := txscript.NewScriptBuilder()
+	for _, sig := range sigs {
+		builder.AddData(sig)
+	}
+	if redeemScript != nil {
+		builder.AddData(redeemScript)
+	}
+	return builder.Script()
+}
+
+// LockSpendScript returns the signature script of a pay-to-script-hash output
+// of a LockTimeScript or a SequenceLockScript.
+func LockSpendScript(sig []byte, redeemScript []byte) ([]byte, error) {
+	return txscript.NewScriptBuilder().AddData(sig).AddData(redeemScript).
+		Script()
+}
+
+// HashLockSpendScript returns the signature script of a pay-to-script-hash
+// output of a HashLockScript.
+func HashLockSpendScript(sig []byte, preimage []byte, redeemScript []byte) ([]byte, error) {
+	return txscript.NewScriptBuilder().AddData(sig).AddData(preimage).
+		AddData(redeemScript).Script()
+}
+
+// MultiSigSigner returns the ScriptSigner of a multisig output signing with
+// the passed keys, ordered like their public keys in the multisig script.
+// The script is revealed in the signature script when p2sh is set.
+func MultiSigSigner(keys []coinharness.PrivateKey, multiSigScript []byte, p2sh bool) ScriptSigner {
+	return func(tx *coinharness.MessageTx, index int) ([]byte, error) {
+		sigs := make([][]byte, len(keys))
+		for i, key := range keys {
+			sig, err := InputSignature(tx, index, multiSigScript, key)
+			if err != nil {
+				return nil, err
+			}
+			sigs[i] = sig
+		}
+		if !p2sh {
+			return MultiSigSpendScript(sigs, nil)
+		}
+		return MultiSigSpendScript(sigs, multiSigScript)
+	}
+}
+
+// LockSigner returns the ScriptSigner of a pay-to-script-hash output of a
+// LockTimeScript or a SequenceLockScript.
+func LockSigner(key coinharness.PrivateKey, redeemScript []byte) ScriptSigner {
+	return func(tx *coinharness.MessageTx, index int) ([]byte, error) {
+		sig, err := InputSignature(tx, index, redeemScript, key)
+		if err != nil {
+			return nil, err
+		}
+		return LockSpendScript(sig, redeemScript)
+	}
+}
+
+// HashLockSigner returns the ScriptSigner of a pay-to-script-hash output of a
+// HashLockScript revealing the passed preimage.
+func HashLockSigner(key coinharness.PrivateKey, preimage []byte, redeemScript []byte) ScriptSigner {
+	return func(tx *coinharness.MessageTx, index int) ([]byte, error) {
+		sig, err := InputSignature(tx, index, redeemScript, key)
+		if err != nil {
+			return nil, err
+		}
+		return HashLockSpendScript(sig, preimage, redeemScript)
+	}
+}
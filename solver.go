@@ -0,0 +1,181 @@
+package btcharness
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/picfight/pfcd/blockchain"
+	"github.com/picfight/pfcd/txscript"
+	"github.com/picfight/pfcd/wire"
+)
+
+const (
+	// nonceSpace is the number of distinct values of the header nonce.
+	nonceSpace = uint64(1) << 32
+
+	// ctxCheckInterval is the number of hashes a solver worker performs
+	// between checks of the context for cancellation.
+	ctxCheckInterval = 1 << 14
+)
+
+// solveBlock attempts to find a nonce which makes the passed block header hash
+// to a value less than the target difficulty encoded in the header bits. The
+// search is spread over all available cores. Each time the entire nonce space
+// is exhausted, the coinbase extranonce is rolled and the merkle root rebuilt.
+// The smallest solving nonce of a round always wins, so the result does not
+// depend on the number of workers or their scheduling.
+//
+// When a solution is found, the nonce field of the passed block header is
+// updated and nil is returned. An error is returned once the context is done.
+func solveBlock(ctx context.Context, block *wire.MsgBlock) error {
+	header := &block.Header
+	targetDifficulty := blockchain.CompactToBig(header.Bits)
+	if targetDifficulty.Sign() <= 0 {
+		return errors.New("unable to solve block: invalid target difficulty")
+	}
+
+	extraNonce := coinbaseExtraNonce(block)
+	for {
+		nonce, found, err := solveHeader(ctx, *header, targetDifficulty)
+		if err != nil {
+			return err
+		}
+		if found {
+			header.Nonce = nonce
+			return nil
+		}
+
+		// The nonce space is exhausted, roll the extranonce and try
+		// again with the new merkle root.
+		extraNonce++
+		if err := updateExtraNonce(block, extraNonce); err != nil {
+			return err
+		}
+	}
+}
+
+// solveHeader searches the entire nonce space of the passed header concurrently
+// and returns the smallest nonce which solves it. False is returned if no
+// solution exists for the current header. A nil context means no limit.
+func solveHeader(ctx context.Context, header wire.BlockHeader, targetDifficulty *big.Int) (uint32, bool, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	workers := uint64(runtime.NumCPU())
+
+	// best holds the smallest solving nonce found so far, nonceSpace
+	// indicates that no solution has been found yet.
+	best := nonceSpace
+	var wg sync.WaitGroup
+	for w := uint64(0); w < workers; w++ {
+		wg.Add(1)
+		go func(header wire.BlockHeader, start uint64) {
+			defer wg.Done()
+			hashes := 0
+			for i := start; i < nonceSpace; i += workers {
+				// Any further solution of this worker can't beat
+				// the one already found.
+				if i >= atomic.LoadUint64(&best) {
+					return
+				}
+				hashes++
+				if hashes%ctxCheckInterval == 0 && ctx.Err() != nil {
+					return
+				}
+
+				// Update the nonce and hash the block header.
+				header.Nonce = uint32(i)
+				hash := header.BlockHash()
+
+				// The block is solved when the new block hash is
+				// less than the target difficulty.  Yay!
+				if blockchain.HashToBig(&hash).Cmp(targetDifficulty) > 0 {
+					continue
+				}
+				for {
+					current := atomic.LoadUint64(&best)
+					if i >= current || atomic.CompareAndSwapUint64(&best, current, i) {
+						return
+					}
+				}
+			}
+		}(header, w)
+	}
+	wg.Wait()
+
+	if best < nonceSpace {
+		return uint32(best), true, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, false, err
+	}
+	return 0, false, nil
+}
+
+// coinbaseExtraNonce returns the extranonce currently encoded into the OP_RETURN
+// output of the coinbase transaction of the passed block. Zero is returned when
+// the coinbase carries no such output.
+func coinbaseExtraNonce(block *wire.MsgBlock) uint64 {
+	index := extraNonceOutputIndex(block.Transactions[0])
+	if index < 0 {
+		return 0
+	}
+	data, err := txscript.PushedData(block.Transactions[0].TxOut[index].PkScript)
+	if err != nil || len(data) == 0 || len(data[0]) != 12 {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(data[0][4:12])
+}
+
+// updateExtraNonce rewrites the coinbase signature script and the coinbase
+// OP_RETURN output (if any) with the passed extranonce and rebuilds the merkle
+// root and the size of the block.
+func updateExtraNonce(block *wire.MsgBlock, extraNonce uint64) error {
+	height := int64(block.Header.Height)
+	coinbaseTx := block.Transactions[0]
+
+	coinbaseScript, err := standardCoinbaseScript(height, extraNonce)
+	if err != nil {
+		return err
+	}
+	coinbaseTx.TxIn[0].SignatureScript = coinbaseScript
+
+	if index := extraNonceOutputIndex(coinbaseTx); index >= 0 {
+		opReturnPkScript, err := standardCoinbaseOpReturn(height, extraNonce)
+		if err != nil {
+			return err
+		}
+		coinbaseTx.TxOut[index].PkScript = opReturnPkScript
+	}
+
+	updateMerkleRootAndSize(block)
+	return nil
+}
+
+// updateMerkleRootAndSize rebuilds the merkle root and the size of the passed
+// block after its transactions have been altered.
+func updateMerkleRootAndSize(block *wire.MsgBlock) {
+	merkles := blockchain.BuildMsgTxMerkleTreeStore(block.Transactions)
+	block.Header.MerkleRoot = *merkles[len(merkles)-1]
+	block.Header.Size = uint32(block.SerializeSize())
+}
+
+// extraNonceOutputIndex returns the index of the zero-valued OP_RETURN output
+// created by standardCoinbaseOpReturn, or -1 if the coinbase has none.
+func extraNonceOutputIndex(coinbaseTx *wire.MsgTx) int {
+	for i, txOut := range coinbaseTx.TxOut {
+		if txOut.Value != 0 {
+			continue
+		}
+		class := txscript.GetScriptClass(txOut.Version, txOut.PkScript)
+		if class == txscript.NullDataTy {
+			return i
+		}
+	}
+	return -1
+}
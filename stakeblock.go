@@ -0,0 +1,148 @@
+package btcharness
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/jfixby/coinharness"
+	"github.com/picfight/pfcd/blockchain/stake"
+	"github.com/picfight/pfcd/chaincfg"
+	"github.com/picfight/pfcd/chaincfg/chainhash"
+	"github.com/picfight/pfcd/dcrutil"
+	"github.com/picfight/pfcd/rpcclient"
+	"github.com/picfight/pfcd/wire"
+)
+
+// StakeState bundles the header stake commitments a new block has to carry
+// on top of the previous block
+type StakeState struct {
+	// VoteBits is the header vote bits. The BlockValid bit is overridden
+	// by the majority of the votes included into the block once the stake
+	// validation height is reached.
+	VoteBits uint16
+
+	// FinalState is the final state of the ticket lottery of the
+	// previous block
+	FinalState [6]byte
+
+	// PoolSize is the number of live tickets after the previous block
+	PoolSize uint32
+
+	// SBits is the stake difficulty (ticket price) of the new block
+	SBits int64
+
+	StakeVersion uint32
+
+	// Winners are the tickets eligible to vote on the previous block,
+	// nil before the stake validation height
+	Winners []*chainhash.Hash
+}
+
+// FetchStakeState fetches from the node the stake state required to build a
+// block on top of the node's best block.
+func FetchStakeState(client coinharness.RPCClient, net *chaincfg.Params) (*StakeState, error) {
+	rpc := client.Internal().(*rpcclient.Client)
+
+	tipHash, _, err := rpc.GetBestBlock()
+	if err != nil {
+		return nil, err
+	}
+	tip, err := rpc.GetBlockHeader(tipHash)
+	if err != nil {
+		return nil, err
+	}
+	stakeDiff, err := rpc.GetStakeDifficulty()
+	if err != nil {
+		return nil, err
+	}
+	sbits, err := dcrutil.NewAmount(stakeDiff.NextStakeDifficulty)
+	if err != nil {
+		return nil, err
+	}
+	liveTickets, err := rpc.LiveTickets()
+	if err != nil {
+		return nil, err
+	}
+	_, stakeVersion, err := ResolveBlockVersion(client, net)
+	if err != nil {
+		return nil, err
+	}
+
+	winners, finalState, err := CalcTicketLottery(tip, liveTickets, net)
+	if err != nil {
+		return nil, err
+	}
+	return &StakeState{
+		VoteBits:     dcrutil.BlockValid,
+		FinalState:   finalState,
+		PoolSize:     uint32(len(liveTickets)),
+		SBits:        int64(sbits),
+		StakeVersion: stakeVersion,
+		Winners:      winners,
+	}, nil
+}
+
+// CalcTicketLottery selects the tickets eligible to vote on the passed block
+// from the live tickets after that block and calculates the final state of the
+// lottery the same way the node does. No winners and a zero final state are
+// returned for blocks below the stake validation height.
+func CalcTicketLottery(header *wire.BlockHeader, liveTickets []*chainhash.Hash, net *chaincfg.Params) ([]*chainhash.Hash, [6]byte, error) {
+	var finalState [6]byte
+	// The first block voted on is at StakeValidationHeight, so the
+	// winners are selected starting with the block before it.
+	if int64(header.Height) < net.StakeValidationHeight-1 {
+		return nil, finalState, nil
+	}
+
+	headerBytes, err := header.Bytes()
+	if err != nil {
+		return nil, finalState, err
+	}
+	prng := stake.NewHash256PRNGFromIV(stake.CalcHash256PRNGIV(headerBytes))
+	idxs, err := stake.FindTicketIdxs(len(liveTickets), net.TicketsPerBlock,
+		prng)
+	if err != nil {
+		return nil, finalState, err
+	}
+
+	// The node keeps the live tickets sorted by hash.
+	sorted := make([]*chainhash.Hash, len(liveTickets))
+	copy(sorted, liveTickets)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i][:], sorted[j][:]) < 0
+	})
+
+	winners := make([]*chainhash.Hash, 0, len(idxs))
+	stateBuffer := make([]byte, 0,
+		(int(net.TicketsPerBlock)+1)*chainhash.HashSize)
+	for _, idx := range idxs {
+		winners = append(winners, sorted[idx])
+		stateBuffer = append(stateBuffer, sorted[idx][:]...)
+	}
+	lastHash := prng.StateHash()
+	stateBuffer = append(stateBuffer, lastHash[:]...)
+	copy(finalState[:], chainhash.HashB(stateBuffer)[0:6])
+	return winners, finalState, nil
+}
+
+// stakeTreeCounts tallies the tickets, votes and revocations of the passed
+// stake transactions along with the number of votes approving the previous
+// block.
+func stakeTreeCounts(stxns []*dcrutil.Tx) (tickets, votes, revocations, yesVotes uint16) {
+	for _, tx := range stxns {
+		msgTx := tx.MsgTx()
+		switch stake.DetermineTxType(msgTx) {
+		case stake.TxTypeSStx:
+			tickets++
+		case stake.TxTypeSSGen:
+			votes++
+			if dcrutil.IsFlagSet16(stake.SSGenVoteBits(msgTx),
+				dcrutil.BlockValid) {
+				yesVotes++
+			}
+		case stake.TxTypeSSRtx:
+			revocations++
+		}
+	}
+	return tickets, votes, revocations, yesVotes
+}
@@ -0,0 +1,318 @@
+package btcharness
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/jfixby/coinharness"
+	"github.com/picfight/pfcd/blockchain"
+	"github.com/picfight/pfcd/blockchain/stake"
+	"github.com/picfight/pfcd/chaincfg"
+	"github.com/picfight/pfcd/chaincfg/chainhash"
+	"github.com/picfight/pfcd/dcrutil"
+	"github.com/picfight/pfcd/rpcclient"
+	"github.com/picfight/pfcd/txscript"
+	"github.com/picfight/pfcd/wire"
+)
+
+// DefaultTicketFeeLimits are the commitment fee limits of the tickets built by
+// NewTicketPurchase: votes pay no fee and revocations pay up to 2^24 atoms.
+const DefaultTicketFeeLimits = stake.SStxRevFractionFlag | 24<<8
+
+// Ticket is a ticket purchase along with its location in the stake tree of the
+// chain
+type Ticket struct {
+	Tx *wire.MsgTx
+
+	// BlockHeight and BlockIndex locate the ticket, they are committed to
+	// by the votes and the revocations spending it and may be left zero
+	// when those are sent to the node
+	BlockHeight uint32
+	BlockIndex  uint32
+}
+
+// FetchTicket fetches the ticket purchase with the passed hash from the node.
+func FetchTicket(client coinharness.RPCClient, hash *chainhash.Hash) (*Ticket, error) {
+	rpc := client.Internal().(*rpcclient.Client)
+
+	tx, err := rpc.GetRawTransactionVerbose(hash)
+	if err != nil {
+		return nil, err
+	}
+	txBytes, err := hex.DecodeString(tx.Hex)
+	if err != nil {
+		return nil, err
+	}
+	msgTx := wire.NewMsgTx()
+	if err := msgTx.FromBytes(txBytes); err != nil {
+		return nil, err
+	}
+	if !stake.IsSStx(msgTx) {
+		return nil, fmt.Errorf("transaction %v is not a ticket purchase",
+			hash)
+	}
+	return &Ticket{
+		Tx:          msgTx,
+		BlockHeight: uint32(tx.BlockHeight),
+		BlockIndex:  tx.BlockIndex,
+	}, nil
+}
+
+// TicketPurchaseArgs bundles NewTicketPurchase() arguments to minimize diff
+// in case a new argument for the function is added
+type TicketPurchaseArgs struct {
+	// Inputs fund the ticket, each of them gets a reward commitment
+	Inputs  []*SpendableOutput
+	KeyRing *KeyRing
+
+	// TicketPrice has to match the current stake difficulty
+	TicketPrice int64
+
+	// VotingAddress is the address whose key votes or revokes the ticket
+	VotingAddress dcrutil.Address
+
+	// RewardAddress receives the payouts of the vote or the revocation
+	RewardAddress dcrutil.Address
+
+	// ChangeAddress receives the value of the inputs above the ticket price
+	// and the fee
+	ChangeAddress dcrutil.Address
+
+	// FeePerKB is the fee rate, DefaultMinRelayTxFee when zero
+	FeePerKB int64
+
+	Expiry  uint32
+	Network *chaincfg.Params
+}
+
+// NewTicketPurchase creates and signs a ticket purchase (SStx).
+func NewTicketPurchase(args *TicketPurchaseArgs) (*wire.MsgTx, error) {
+	if len(args.Inputs) == 0 {
+		return nil, fmt.Errorf("ticket purchase has no inputs")
+	}
+	feePerKB := args.FeePerKB
+	if feePerKB == 0 {
+		feePerKB = int64(DefaultMinRelayTxFee)
+	}
+	ticketScript, err := txscript.PayToSStx(args.VotingAddress)
+	if err != nil {
+		return nil, err
+	}
+	changeScript, err := txscript.PayToSStxChange(args.ChangeAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	totalIn := int64(0)
+	for _, input := range args.Inputs {
+		totalIn += input.Value
+	}
+
+	tx := wire.NewMsgTx()
+	tx.Expiry = args.Expiry
+	for _, input := range args.Inputs {
+		tx.AddTxIn(input.TxIn())
+	}
+	tx.AddTxOut(wire.NewTxOut(args.TicketPrice, ticketScript))
+	for range args.Inputs {
+		tx.AddTxOut(wire.NewTxOut(0, nil))
+		tx.AddTxOut(wire.NewTxOut(0, changeScript))
+	}
+
+	fee := int64(0)
+	for i := 0; i < maxFeeIterations; i++ {
+		change := totalIn - args.TicketPrice - fee
+		if change < 0 {
+			return nil, fmt.Errorf("inputs spend %v, not enough to pay "+
+				"the ticket price %v and the fee %v",
+				dcrutil.Amount(totalIn),
+				dcrutil.Amount(args.TicketPrice), dcrutil.Amount(fee))
+		}
+		// The change is taken from the first inputs, the rest of their
+		// value is committed to the ticket.
+		for j, input := range args.Inputs {
+			inputChange := change
+			if inputChange > input.Value {
+				inputChange = input.Value
+			}
+			change -= inputChange
+
+			commitment, err := txscript.GenerateSStxAddrPush(
+				args.RewardAddress,
+				dcrutil.Amount(input.Value-inputChange),
+				DefaultTicketFeeLimits)
+			if err != nil {
+				return nil, err
+			}
+			tx.TxOut[1+2*j].PkScript = commitment
+			tx.TxOut[2+2*j].Value = inputChange
+		}
+		if err := signTxInputs(tx, args.Inputs, args.KeyRing); err != nil {
+			return nil, err
+		}
+		required := feePerKB * int64(tx.SerializeSize()) / 1000
+		if required <= fee {
+			break
+		}
+		fee = required
+	}
+	return tx, nil
+}
+
+// VoteArgs bundles NewVote() arguments to minimize diff in case a new argument
+// for the function is added
+type VoteArgs struct {
+	Ticket *Ticket
+
+	// KeyRing holds the key of the voting address of the ticket
+	KeyRing *KeyRing
+
+	// BlockHash and BlockHeight identify the block voted on, the vote is
+	// included in the block on top of it
+	BlockHash   chainhash.Hash
+	BlockHeight int64
+
+	// VoteBits approve the block voted on with dcrutil.BlockValid and
+	// carry the choices on the agendas
+	VoteBits    uint16
+	VoteVersion uint32
+
+	Network *chaincfg.Params
+}
+
+// NewVote creates and signs a vote (SSGen) of the passed ticket paying the
+// ticket price along with the vote subsidy to the reward commitments of the
+// ticket.
+func NewVote(args *VoteArgs) (*wire.MsgTx, error) {
+	net := args.Network
+	// Consensus computes the vote subsidy at the height of the block voted
+	// on, not at the height of the block including the vote.
+	subsidy := blockchain.CalcStakeVoteSubsidy(
+		blockchain.NewSubsidyCache(0, net), args.BlockHeight, net)
+
+	blockRef, err := txscript.GenerateSSGenBlockRef(args.BlockHash,
+		uint32(args.BlockHeight))
+	if err != nil {
+		return nil, err
+	}
+	votes := make([]byte, 6)
+	binary.LittleEndian.PutUint16(votes[0:2], args.VoteBits)
+	binary.LittleEndian.PutUint32(votes[2:6], args.VoteVersion)
+	voteScript, err := txscript.NewScriptBuilder().
+		AddOp(txscript.OP_RETURN).AddData(votes).Script()
+	if err != nil {
+		return nil, err
+	}
+
+	tx := wire.NewMsgTx()
+	tx.AddTxIn(&wire.TxIn{
+		// The stakebase input creates the vote subsidy.
+		PreviousOutPoint: *wire.NewOutPoint(&chainhash.Hash{},
+			wire.MaxPrevOutIndex, wire.TxTreeRegular),
+		Sequence:        wire.MaxTxInSequenceNum,
+		ValueIn:         subsidy,
+		BlockHeight:     wire.NullBlockHeight,
+		BlockIndex:      wire.NullBlockIndex,
+		SignatureScript: net.StakeBaseSigScript,
+	})
+	ticketOut := ticketOutput(args.Ticket)
+	tx.AddTxIn(ticketOut.TxIn())
+	tx.AddTxOut(wire.NewTxOut(0, blockRef))
+	tx.AddTxOut(wire.NewTxOut(0, voteScript))
+
+	err = addTicketPayouts(tx, args.Ticket, subsidy, 0, txscript.OP_SSGEN)
+	if err != nil {
+		return nil, err
+	}
+	if err := args.KeyRing.SignInput(tx, 1, ticketOut.PkScript); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// RevocationArgs bundles NewRevocation() arguments to minimize diff in case a
+// new argument for the function is added
+type RevocationArgs struct {
+	Ticket *Ticket
+
+	// KeyRing holds the key of the voting address of the ticket
+	KeyRing *KeyRing
+
+	// Fee is taken from the first payout covering it, within the
+	// revocation fee limit of its commitment
+	Fee int64
+}
+
+// NewRevocation creates and signs a revocation (SSRtx) of the passed missed or
+// expired ticket returning the ticket price to its reward commitments.
+func NewRevocation(args *RevocationArgs) (*wire.MsgTx, error) {
+	tx := wire.NewMsgTx()
+	ticketOut := ticketOutput(args.Ticket)
+	tx.AddTxIn(ticketOut.TxIn())
+
+	err := addTicketPayouts(tx, args.Ticket, 0, args.Fee, txscript.OP_SSRTX)
+	if err != nil {
+		return nil, err
+	}
+	if err := args.KeyRing.SignInput(tx, 0, ticketOut.PkScript); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// ticketOutput returns the stake output of the passed ticket.
+func ticketOutput(ticket *Ticket) *SpendableOutput {
+	ticketHash := ticket.Tx.TxHash()
+	ticketOut := ticket.Tx.TxOut[0]
+	return &SpendableOutput{
+		OutPoint:    *wire.NewOutPoint(&ticketHash, 0, wire.TxTreeStake),
+		Value:       ticketOut.Value,
+		PkScript:    ticketOut.PkScript,
+		BlockHeight: ticket.BlockHeight,
+		BlockIndex:  ticket.BlockIndex,
+	}
+}
+
+// addTicketPayouts adds to the vote or the revocation the outputs paying the
+// ticket price and the subsidy to the reward commitments of the ticket, less
+// the fee taken from the first payout covering it.
+func addTicketPayouts(tx *wire.MsgTx, ticket *Ticket, subsidy int64, fee int64, opcode byte) error {
+	isP2SH, hashes, amounts, _, _, _ := stake.TxSStxStakeOutputInfo(
+		ticket.Tx)
+	payouts := stake.CalculateRewards(amounts, ticket.Tx.TxOut[0].Value,
+		subsidy)
+	if fee > 0 {
+		feePayout := -1
+		for i, payout := range payouts {
+			if payout >= fee {
+				feePayout = i
+				break
+			}
+		}
+		if feePayout < 0 {
+			return fmt.Errorf("no payout of ticket %v covers the fee %v",
+				ticket.Tx.TxHash(), dcrutil.Amount(fee))
+		}
+		payouts[feePayout] -= fee
+	}
+	for i, payout := range payouts {
+		var script []byte
+		var err error
+		switch {
+		case opcode == txscript.OP_SSGEN && isP2SH[i]:
+			script, err = txscript.PayToSSGenSHDirect(hashes[i])
+		case opcode == txscript.OP_SSGEN:
+			script, err = txscript.PayToSSGenPKHDirect(hashes[i])
+		case isP2SH[i]:
+			script, err = txscript.PayToSSRtxSHDirect(hashes[i])
+		default:
+			script, err = txscript.PayToSSRtxPKHDirect(hashes[i])
+		}
+		if err != nil {
+			return err
+		}
+		tx.AddTxOut(wire.NewTxOut(payout, script))
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package btcharness
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/jfixby/coinharness"
+	"github.com/picfight/pfcd/chaincfg"
+	"github.com/picfight/pfcd/dcrec/secp256k1"
+	"github.com/picfight/pfcd/dcrutil"
+	"github.com/picfight/pfcd/rpcclient"
+	"github.com/picfight/pfcd/txscript"
+	"github.com/picfight/pfcd/wire"
+)
+
+// opTrueScript is the anyone-can-spend script the coinbase pays the tax to when
+// the tax is disabled. Spending inputs are non-standard, so the spending
+// transactions have to be mined directly, for example with
+// GenerateBlockArgs.Txns.
+var opTrueScript = []byte{txscript.OP_TRUE}
+
+// wellKnownOrganizationRedeemScripts are the 3-of-3 multisig redeem scripts of
+// the OrganizationPkScript of the simulation and the regression test networks,
+// as documented along with the network parameters. The keys of the scripts are
+// owned by the well-known wallet.
+var wellKnownOrganizationRedeemScripts = map[wire.CurrencyNet]string{
+	wire.SimNet: "532103e8c60c7336744c8dcc7b85c27789950fc52aa4e48f895ebbfb" +
+		"ac383ab893fc4c2103ff9afc246e0921e37d12e17d8296ca06a8f92a07fbe7857ed1d4" +
+		"f0f5d94e988f21033ed09c7fa8b83ed53e6f2c57c5fa99ed2230c0d38edf53c0340d0f" +
+		"c2e79c725a53ae",
+	wire.RegNet: "53210323c1b9aa4facca85df363fb4abd5c52fe2af4746fbb5f99a6d" +
+		"cc2edb633fe2a62103c2d8a61a2800092ddaf04ba30dfc7cf1ab4130ac1d2398ba15fc" +
+		"795b11bc690621035fe97a7b2d6b98242f4bfc33d86a564158b44634b93cdefa155909" +
+		"5d4bf6167853ae",
+}
+
+// TaxOutput returns the output of the coinbase of the passed block paying the
+// block tax, either to the OrganizationPkScript of the network or to the
+// OP_TRUE script when the tax is disabled. Nil is returned for blocks without
+// a tax output such as the genesis block and block one when it pays the
+// ledger.
+func TaxOutput(block *dcrutil.Block, net *chaincfg.Params) (*SpendableOutput, error) {
+	height := block.Height()
+	if height == 0 || usesBlockOneLedger(height, net) {
+		return nil, nil
+	}
+	coinbaseTx := block.Transactions()[0]
+	if len(coinbaseTx.MsgTx().TxOut) == 0 {
+		return nil, fmt.Errorf("coinbase of block %v has no outputs",
+			block.Hash())
+	}
+	txOut := coinbaseTx.MsgTx().TxOut[0]
+	if !isTaxScript(txOut.PkScript, net) {
+		return nil, fmt.Errorf("coinbase of block %v pays the tax to an "+
+			"unexpected script %x", block.Hash(), txOut.PkScript)
+	}
+	return &SpendableOutput{
+		OutPoint: *wire.NewOutPoint(coinbaseTx.Hash(), 0,
+			wire.TxTreeRegular),
+		Value:       txOut.Value,
+		PkScript:    txOut.PkScript,
+		BlockHeight: uint32(height),
+		BlockIndex:  0,
+	}, nil
+}
+
+// isTaxScript returns whether the passed script is the one the network pays the
+// block tax to.
+func isTaxScript(pkScript []byte, net *chaincfg.Params) bool {
+	if net.BlockTaxProportion > 0 {
+		return bytes.Equal(pkScript, net.OrganizationPkScript)
+	}
+	return bytes.Equal(pkScript, opTrueScript)
+}
+
+// FetchTaxOutputs fetches the blocks from the start height to the end height,
+// inclusive, from the node and returns their tax outputs ordered by height.
+// Outputs still spent by the node are not filtered, zero-value outputs are
+// skipped.
+func FetchTaxOutputs(client coinharness.RPCClient, start, end int64, net *chaincfg.Params) ([]*SpendableOutput, error) {
+	rpc := client.Internal().(*rpcclient.Client)
+
+	var outputs []*SpendableOutput
+	for height := start; height <= end; height++ {
+		hash, err := rpc.GetBlockHash(height)
+		if err != nil {
+			return nil, err
+		}
+		mBlock, err := rpc.GetBlock(hash)
+		if err != nil {
+			return nil, err
+		}
+		output, err := TaxOutput(dcrutil.NewBlock(mBlock), net)
+		if err != nil {
+			return nil, err
+		}
+		if output == nil || output.Value == 0 {
+			continue
+		}
+		outputs = append(outputs, output)
+	}
+	return outputs, nil
+}
+
+// FetchMatureTaxOutputs returns the tax outputs of the blocks of the node's
+// best chain which have reached the coinbase maturity and are still unspent.
+func FetchMatureTaxOutputs(client coinharness.RPCClient, net *chaincfg.Params) ([]*SpendableOutput, error) {
+	rpc := client.Internal().(*rpcclient.Client)
+
+	_, bestHeight, err := rpc.GetBestBlock()
+	if err != nil {
+		return nil, err
+	}
+	end := bestHeight - int64(net.CoinbaseMaturity)
+	if end < 1 {
+		return nil, nil
+	}
+	outputs, err := FetchTaxOutputs(client, 1, end, net)
+	if err != nil {
+		return nil, err
+	}
+	var unspent []*SpendableOutput
+	for _, output := range outputs {
+		txOut, err := rpc.GetTxOut(&output.OutPoint.Hash,
+			output.OutPoint.Index, false)
+		if err != nil {
+			return nil, err
+		}
+		if txOut != nil {
+			unspent = append(unspent, output)
+		}
+	}
+	return unspent, nil
+}
+
+// OrganizationKeyRing returns a KeyRing holding the passed organization keys
+// and the passed redeem script of the OrganizationPkScript of the network.
+func OrganizationKeyRing(keys []*secp256k1.PrivateKey, redeemScript []byte, net *chaincfg.Params) (*KeyRing, error) {
+	ring := NewKeyRing(net)
+	for _, key := range keys {
+		if _, err := ring.AddKey(key); err != nil {
+			return nil, err
+		}
+	}
+	addr, err := ring.AddScript(redeemScript)
+	if err != nil {
+		return nil, err
+	}
+	pkScript, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(pkScript, net.OrganizationPkScript) {
+		return nil, fmt.Errorf("redeem script does not match the "+
+			"organization script %x of %v", net.OrganizationPkScript,
+			net.Name)
+	}
+	return ring, nil
+}
+
+// DefaultOrganizationKeyRing returns the OrganizationKeyRing of the simulation
+// and the regression test networks, whose organization keys are owned by the
+// well-known wallet. An error is returned for other networks.
+func DefaultOrganizationKeyRing(net *chaincfg.Params) (*KeyRing, error) {
+	scriptHex, ok := wellKnownOrganizationRedeemScripts[net.Net]
+	if !ok {
+		return nil, fmt.Errorf("organization keys of %v are not owned by "+
+			"the well-known wallet", net.Name)
+	}
+	redeemScript, err := hex.DecodeString(scriptHex)
+	if err != nil {
+		return nil, err
+	}
+	_, addrs, _, err := txscript.ExtractPkScriptAddrs(
+		txscript.DefaultScriptVersion, redeemScript, net)
+	if err != nil {
+		return nil, err
+	}
+
+	// The keys of the script are the keys of the block one ledger.
+	ledger, err := DefaultBlockOneLedger(net)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*secp256k1.PrivateKey, 0, len(addrs))
+	for _, addr := range addrs {
+		var found *secp256k1.PrivateKey
+		for _, entry := range ledger {
+			pubKey := (*secp256k1.PublicKey)(&entry.Key.PublicKey)
+			if bytes.Equal(pubKey.SerializeCompressed(),
+				addr.ScriptAddress()) {
+				found = entry.Key
+				break
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("no key of the well-known wallet "+
+				"for the organization key %v", addr)
+		}
+		keys = append(keys, found)
+	}
+	return OrganizationKeyRing(keys, redeemScript, net)
+}
@@ -0,0 +1,259 @@
+package btcharness
+
+import (
+	"container/heap"
+	"fmt"
+
+	"github.com/jfixby/coinharness"
+	"github.com/picfight/pfcd/chaincfg"
+	"github.com/picfight/pfcd/chaincfg/chainhash"
+	"github.com/picfight/pfcd/dcrjson"
+	"github.com/picfight/pfcd/dcrutil"
+	"github.com/picfight/pfcd/rpcclient"
+	"github.com/picfight/pfcd/wire"
+)
+
+// MempoolSelection instructs block generators to fill the regular transaction
+// tree of the block with transactions pulled from the node's mempool
+type MempoolSelection struct {
+	// MaxBlockSize limits the serialized size of the block,
+	// zero means the smallest of the network MaximumBlockSizes
+	MaxBlockSize int
+}
+
+// MempoolTx is a mempool transaction considered for inclusion into a block
+type MempoolTx struct {
+	Tx *dcrutil.Tx
+
+	// Fee is the fee paid by the transaction in atoms
+	Fee int64
+
+	// Size is the serialized size of the transaction
+	Size int
+
+	// Depends are the mempool transactions the transaction spends from
+	Depends []*chainhash.Hash
+}
+
+// FeePerKB returns the fee rate of the transaction in atoms per kilobyte.
+func (m *MempoolTx) FeePerKB() int64 {
+	if m.Size == 0 {
+		return 0
+	}
+	return m.Fee * 1000 / int64(m.Size)
+}
+
+// FetchMempoolTxns fetches the regular transactions of the node's mempool along
+// with their fees and mempool dependencies.
+func FetchMempoolTxns(client coinharness.RPCClient) ([]*MempoolTx, error) {
+	rpc := client.Internal().(*rpcclient.Client)
+
+	entries, err := rpc.GetRawMempoolVerbose(dcrjson.GRMRegular)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*MempoolTx, 0, len(entries))
+	for txHashStr, entry := range entries {
+		txHash, err := chainhash.NewHashFromStr(txHashStr)
+		if err != nil {
+			return nil, err
+		}
+		tx, err := rpc.GetRawTransaction(txHash)
+		if isNoTxInfoError(err) {
+			// The transaction has been mined or evicted since
+			// the mempool was listed, SelectMempoolTxns() drops
+			// the transactions depending on it.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		fee, err := dcrutil.NewAmount(entry.Fee)
+		if err != nil {
+			return nil, err
+		}
+		mempoolTx := &MempoolTx{
+			Tx:   tx,
+			Fee:  int64(fee),
+			Size: tx.MsgTx().SerializeSize(),
+		}
+		for _, dependStr := range entry.Depends {
+			depend, err := chainhash.NewHashFromStr(dependStr)
+			if err != nil {
+				return nil, err
+			}
+			mempoolTx.Depends = append(mempoolTx.Depends, depend)
+		}
+		result = append(result, mempoolTx)
+	}
+	return result, nil
+}
+
+// SelectMempoolTxns orders the passed mempool transactions by fee rate while
+// keeping every transaction after the mempool transactions it depends on and
+// selects as many of them as fit into maxSize bytes. Transactions depending on
+// a transaction which is not selected or not among the passed ones are left
+// out.
+func SelectMempoolTxns(txns []*MempoolTx, maxSize int) []*dcrutil.Tx {
+	byHash := make(map[chainhash.Hash]*MempoolTx, len(txns))
+	for _, tx := range txns {
+		byHash[*tx.Tx.Hash()] = tx
+	}
+
+	// dependers maps a transaction to the transactions waiting for it
+	// to be selected, unmet counts the dependencies of a transaction
+	// which are still to be selected.
+	dependers := make(map[chainhash.Hash][]*MempoolTx)
+	unmet := make(map[*MempoolTx]int)
+	queue := &mempoolTxQueue{}
+	for _, tx := range txns {
+		missing := false
+		for _, depend := range tx.Depends {
+			if _, ok := byHash[*depend]; !ok {
+				// The parent is unknown, the transaction and
+				// its dependers are never selected.
+				missing = true
+				continue
+			}
+			dependers[*depend] = append(dependers[*depend], tx)
+			unmet[tx]++
+		}
+		if !missing && unmet[tx] == 0 {
+			heap.Push(queue, tx)
+		}
+	}
+
+	var selected []*dcrutil.Tx
+	size := 0
+	for queue.Len() > 0 {
+		tx := heap.Pop(queue).(*MempoolTx)
+		if size+tx.Size > maxSize {
+			// Skip the transaction along with all of its
+			// dependers.
+			continue
+		}
+		size += tx.Size
+		selected = append(selected, tx.Tx)
+		for _, depender := range dependers[*tx.Tx.Hash()] {
+			unmet[depender]--
+			if unmet[depender] == 0 {
+				heap.Push(queue, depender)
+			}
+		}
+	}
+	return selected
+}
+
+// isNoTxInfoError returns whether the passed error is the node's reply to a
+// request for an unknown transaction.
+func isNoTxInfoError(err error) bool {
+	rpcErr, ok := err.(*dcrjson.RPCError)
+	return ok && rpcErr.Code == dcrjson.ErrRPCNoTxInfo
+}
+
+// mempoolTxQueue is a priority queue of mempool transactions ordered by fee
+// rate, highest first.
+type mempoolTxQueue []*MempoolTx
+
+func (q mempoolTxQueue) Len() int { return len(q) }
+
+func (q mempoolTxQueue) Less(i, j int) bool {
+	rateI, rateJ := q[i].FeePerKB(), q[j].FeePerKB()
+	if rateI != rateJ {
+		return rateI > rateJ
+	}
+	// Keep the order stable for transactions paying the same fee rate.
+	return q[i].Tx.Hash().String() < q[j].Tx.Hash().String()
+}
+
+func (q mempoolTxQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *mempoolTxQueue) Push(x interface{}) {
+	*q = append(*q, x.(*MempoolTx))
+}
+
+func (q *mempoolTxQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	*q = old[:n-1]
+	return item
+}
+
+// selectTemplateTxns pulls the node's mempool and returns the transactions of
+// the regular tree of the block described by args: args.Txns followed by the
+// selected mempool transactions, so mempool transactions spending args.Txns
+// come after them. args.Txns must not spend mempool transactions which are
+// not among args.Txns.
+func selectTemplateTxns(client coinharness.RPCClient, prevHeight int64, args *GenerateBlockArgs) ([]*dcrutil.Tx, error) {
+	maxSize := args.Mempool.MaxBlockSize
+	if maxSize == 0 {
+		maxSize = minimumBlockSize(args.Network)
+	}
+
+	// Reserve the space taken by everything but the mempool
+	// transactions.
+	blockHeight := prevHeight + 1
+	coinbaseScript, err := standardCoinbaseScript(blockHeight, 0)
+	if err != nil {
+		return nil, err
+	}
+	_, voters, _, _ := stakeTreeCounts(args.STxns)
+	coinbaseTx, err := createCoinbaseTx(coinbaseScript, blockHeight,
+		args.MiningAddress, args.MineTo, voters, 0, args.Network)
+	if err != nil {
+		return nil, err
+	}
+	reserved := wire.MaxBlockHeaderPayload + 2*wire.MaxVarIntPayload +
+		coinbaseTx.MsgTx().SerializeSize()
+	excluded := make(map[chainhash.Hash]bool)
+	for _, tx := range args.Txns {
+		reserved += tx.MsgTx().SerializeSize()
+		excluded[*tx.Hash()] = true
+	}
+	for _, tx := range args.STxns {
+		reserved += tx.MsgTx().SerializeSize()
+	}
+	if reserved > maxSize {
+		return nil, fmt.Errorf("block size limit %v is exceeded by "+
+			"the supplied transactions (%v)", maxSize, reserved)
+	}
+
+	mempoolTxns, err := FetchMempoolTxns(client)
+	if err != nil {
+		return nil, err
+	}
+	// args.Txns are left out of the candidates along with the
+	// dependencies on them, which are met by the block.
+	candidates := make([]*MempoolTx, 0, len(mempoolTxns))
+	for _, tx := range mempoolTxns {
+		if excluded[*tx.Tx.Hash()] {
+			continue
+		}
+		candidate := *tx
+		candidate.Depends = nil
+		for _, depend := range tx.Depends {
+			if !excluded[*depend] {
+				candidate.Depends = append(candidate.Depends,
+					depend)
+			}
+		}
+		candidates = append(candidates, &candidate)
+	}
+	selected := SelectMempoolTxns(candidates, maxSize-reserved)
+	txns := make([]*dcrutil.Tx, 0, len(args.Txns)+len(selected))
+	txns = append(txns, args.Txns...)
+	return append(txns, selected...), nil
+}
+
+// minimumBlockSize returns the smallest of the maximum block sizes allowed by
+// the network.
+func minimumBlockSize(net *chaincfg.Params) int {
+	maxSize := wire.MaxBlockPayload
+	for _, size := range net.MaximumBlockSizes {
+		if size < maxSize {
+			maxSize = size
+		}
+	}
+	return maxSize
+}
@@ -1 +1,1344 @@
 package btcharness
+
+import (
+	"bytes"
+	"math/big"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/picfight/pfcd/blockchain"
+	"github.com/picfight/pfcd/chaincfg"
+	"github.com/picfight/pfcd/chaincfg/chainhash"
+	"github.com/picfight/pfcd/dcrec"
+	"github.com/picfight/pfcd/dcrec/secp256k1"
+	"github.com/picfight/pfcd/dcrjson"
+	"github.com/picfight/pfcd/dcrutil"
+	"github.com/picfight/pfcd/txscript"
+	"github.com/picfight/pfcd/wire"
+)
+
+// serTypes are the serialization types a transaction can be converted with
+var serTypes = []wire.TxSerializeType{
+	wire.TxSerializeFull,
+	wire.TxSerializeNoWitness,
+	wire.TxSerializeOnlyWitness,
+}
+
+func randomHash(r *rand.Rand) chainhash.Hash {
+	var hash chainhash.Hash
+	r.Read(hash[:])
+	return hash
+}
+
+func randomBytes(r *rand.Rand, min, max int) []byte {
+	b := make([]byte, min+r.Intn(max-min+1))
+	r.Read(b)
+	return b
+}
+
+// randomMsgTx returns a transaction with random values in every field.
+func randomMsgTx(r *rand.Rand) *wire.MsgTx {
+	tx := &wire.MsgTx{
+		SerType:  serTypes[r.Intn(len(serTypes))],
+		Version:  uint16(r.Uint32()),
+		LockTime: r.Uint32(),
+		Expiry:   r.Uint32(),
+	}
+	for i := 1 + r.Intn(4); i > 0; i-- {
+		tx.TxIn = append(tx.TxIn, &wire.TxIn{
+			PreviousOutPoint: wire.OutPoint{
+				Hash:  randomHash(r),
+				Index: r.Uint32(),
+				Tree:  int8(r.Intn(2)),
+			},
+			Sequence:        r.Uint32(),
+			ValueIn:         r.Int63(),
+			BlockHeight:     r.Uint32(),
+			BlockIndex:      r.Uint32(),
+			SignatureScript: randomBytes(r, 1, 100),
+		})
+	}
+	for i := 1 + r.Intn(4); i > 0; i-- {
+		tx.TxOut = append(tx.TxOut, &wire.TxOut{
+			Value:    r.Int63(),
+			Version:  uint16(r.Uint32()),
+			PkScript: randomBytes(r, 1, 50),
+		})
+	}
+	return tx
+}
+
+// randomBlockHeader returns a block header with random values in every field.
+func randomBlockHeader(r *rand.Rand) *wire.BlockHeader {
+	header := &wire.BlockHeader{
+		Version:      r.Int31(),
+		PrevBlock:    randomHash(r),
+		MerkleRoot:   randomHash(r),
+		StakeRoot:    randomHash(r),
+		VoteBits:     uint16(r.Uint32()),
+		Voters:       uint16(r.Uint32()),
+		FreshStake:   uint8(r.Uint32()),
+		Revocations:  uint8(r.Uint32()),
+		PoolSize:     r.Uint32(),
+		Bits:         r.Uint32(),
+		SBits:        r.Int63(),
+		Height:       r.Uint32(),
+		Size:         r.Uint32(),
+		Timestamp:    time.Unix(int64(r.Uint32()), 0),
+		Nonce:        r.Uint32(),
+		StakeVersion: r.Uint32(),
+	}
+	r.Read(header.FinalState[:])
+	r.Read(header.ExtraData[:])
+	return header
+}
+
+func serializeTx(t *testing.T, tx *wire.MsgTx) []byte {
+	var buf bytes.Buffer
+	if err := tx.Serialize(&buf); err != nil {
+		t.Fatalf("failed to serialize transaction: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestTransactionConversionRoundTrip(t *testing.T) {
+	roundTrip := func(seed int64) bool {
+		r := rand.New(rand.NewSource(seed))
+		tx := randomMsgTx(r)
+		for _, serType := range serTypes {
+			tx.SerType = serType
+			chTx := TransactionRawToTx(tx)
+			raw := TransactionTxToRaw(chTx)
+			if !reflect.DeepEqual(raw, tx) {
+				t.Errorf("seed %v, %v: converted transaction "+
+					"%+v differs from %+v", seed, serType,
+					raw, tx)
+				return false
+			}
+			if !bytes.Equal(serializeTx(t, raw), serializeTx(t, tx)) {
+				t.Errorf("seed %v, %v: serialization differs",
+					seed, serType)
+				return false
+			}
+			wantHash := tx.TxHash()
+			if chTx.TxHash() != wantHash || raw.TxHash() != wantHash {
+				t.Errorf("seed %v, %v: hash %v, want %v", seed,
+					serType, chTx.TxHash(), wantHash)
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransactionConversionFields(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tx := randomMsgTx(r)
+	chTx := TransactionRawToTx(tx)
+
+	if chTx.SerType != uint16(tx.SerType) || chTx.Version != int32(tx.Version) ||
+		chTx.LockTime != tx.LockTime || chTx.Expiry != tx.Expiry {
+		t.Fatalf("transaction fields %+v, want %+v", chTx, tx)
+	}
+	for i, txIn := range tx.TxIn {
+		chIn := chTx.TxIn[i]
+		hash, err := HashToRaw(chIn.PreviousOutPoint.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hash != txIn.PreviousOutPoint.Hash ||
+			chIn.PreviousOutPoint.Index != txIn.PreviousOutPoint.Index ||
+			chIn.PreviousOutPoint.Tree != txIn.PreviousOutPoint.Tree ||
+			chIn.Sequence != txIn.Sequence ||
+			chIn.ValueIn.ToAtoms() != txIn.ValueIn ||
+			chIn.BlockHeight != txIn.BlockHeight ||
+			chIn.BlockIndex != txIn.BlockIndex ||
+			!bytes.Equal(chIn.SignatureScript, txIn.SignatureScript) {
+			t.Fatalf("input %v fields %+v, want %+v", i, chIn, txIn)
+		}
+	}
+	for i, txOut := range tx.TxOut {
+		chOut := chTx.TxOut[i]
+		if chOut.Value.ToAtoms() != txOut.Value ||
+			chOut.Version != txOut.Version ||
+			!bytes.Equal(chOut.PkScript, txOut.PkScript) {
+			t.Fatalf("output %v fields %+v, want %+v", i, chOut, txOut)
+		}
+	}
+}
+
+func TestTransactionConversionCopies(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	tx := randomMsgTx(r)
+	wantHash := tx.TxHash()
+	chTx := TransactionRawToTx(tx)
+
+	// The converted transaction does not share memory with the original.
+	tx.TxIn[0].SignatureScript[0]++
+	tx.TxOut[0].PkScript[0]++
+	tx.TxIn[0].Sequence++
+	if chTx.TxHash() != wantHash {
+		t.Fatalf("modifying the original changed the converted hash")
+	}
+
+	// The hash follows modifications of the converted transaction.
+	chTx.TxIn[0].Sequence++
+	if chTx.TxHash() == wantHash {
+		t.Fatalf("hash did not follow the modified sequence")
+	}
+	if chTx.TxHash() != TransactionTxToRaw(chTx).TxHash() {
+		t.Fatalf("hash differs from the hash of the converted transaction")
+	}
+}
+
+func TestBlockConversionRoundTrip(t *testing.T) {
+	roundTrip := func(seed int64) bool {
+		r := rand.New(rand.NewSource(seed))
+		block := &wire.MsgBlock{Header: *randomBlockHeader(r)}
+		for i := r.Intn(4); i > 0; i-- {
+			block.AddTransaction(randomMsgTx(r))
+		}
+		for i := r.Intn(4); i > 0; i-- {
+			block.AddSTransaction(randomMsgTx(r))
+		}
+
+		chBlock := BlockRawToBlock(block)
+		raw := BlockToRaw(chBlock)
+		if !reflect.DeepEqual(raw, block) {
+			t.Errorf("seed %v: converted block %+v differs from %+v",
+				seed, raw, block)
+			return false
+		}
+		wantHash := block.BlockHash()
+		if chBlock.BlockHash() != wantHash || raw.BlockHash() != wantHash {
+			t.Errorf("seed %v: block hash %v, want %v", seed,
+				chBlock.BlockHash(), wantHash)
+			return false
+		}
+		for i, tx := range block.Transactions {
+			if chBlock.Transactions[i].TxHash() != tx.TxHash() {
+				t.Errorf("seed %v: hash of transaction %v differs",
+					seed, i)
+				return false
+			}
+		}
+		for i, tx := range block.STransactions {
+			if chBlock.STransactions[i].TxHash() != tx.TxHash() {
+				t.Errorf("seed %v: hash of stake transaction "+
+					"%v differs", seed, i)
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlockHeaderConversionRoundTrip(t *testing.T) {
+	roundTrip := func(seed int64) bool {
+		r := rand.New(rand.NewSource(seed))
+		header := randomBlockHeader(r)
+		chHeader := BlockHeaderRawToHeader(header)
+		raw := BlockHeaderToRaw(chHeader)
+		if !reflect.DeepEqual(raw, header) {
+			t.Errorf("seed %v: converted header %+v differs from %+v",
+				seed, raw, header)
+			return false
+		}
+		if chHeader.BlockHash() != header.BlockHash() {
+			t.Errorf("seed %v: header hash differs", seed)
+			return false
+		}
+		if chHeader.Height() != int64(header.Height) {
+			t.Errorf("seed %v: height %v, want %v", seed,
+				chHeader.Height(), header.Height)
+			return false
+		}
+
+		// The wrapped header is a copy.
+		header.Nonce++
+		if chHeader.BlockHash() == header.BlockHash() {
+			t.Errorf("seed %v: header shares memory with the "+
+				"original", seed)
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHashToRaw(t *testing.T) {
+	hash := randomHash(rand.New(rand.NewSource(3)))
+	if got, err := HashToRaw(hash); err != nil || got != hash {
+		t.Fatalf("HashToRaw(value) = %v, %v, want %v", got, err, hash)
+	}
+	if got, err := HashToRaw(&hash); err != nil || got != hash {
+		t.Fatalf("HashToRaw(pointer) = %v, %v, want %v", got, err, hash)
+	}
+	if _, err := HashToRaw((*chainhash.Hash)(nil)); err == nil {
+		t.Fatalf("HashToRaw accepted a nil hash")
+	}
+	if _, err := HashToRaw(hash.String()); err == nil {
+		t.Fatalf("HashToRaw accepted a string")
+	}
+}
+
+func TestTransactionTxToRawErr(t *testing.T) {
+	chTx := TransactionRawToTx(randomMsgTx(rand.New(rand.NewSource(4))))
+	if _, err := TransactionTxToRawErr(chTx); err != nil {
+		t.Fatalf("failed to convert a supported transaction: %v", err)
+	}
+	chTx.TxIn[0].PreviousOutPoint.Hash = "unsupported"
+	if _, err := TransactionTxToRawErr(chTx); err == nil {
+		t.Fatalf("TransactionTxToRawErr accepted an unsupported hash")
+	}
+	key, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := InputSignature(chTx, 0, nil, &PrivateKey{key}); err == nil {
+		t.Fatalf("InputSignature accepted an unsupported hash")
+	}
+}
+
+func TestPublicKeyParse(t *testing.T) {
+	key, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey := (&PrivateKey{key}).PublicKey().(PublicKey)
+
+	for _, serialized := range [][]byte{
+		pubKey.SerializeCompressed(),
+		pubKey.SerializeUncompressed(),
+	} {
+		parsed, err := ParsePublicKey(serialized)
+		if err != nil {
+			t.Fatalf("failed to parse %x: %v", serialized, err)
+		}
+		if !parsed.IsEqual(&pubKey) {
+			t.Fatalf("parsed key %v, want %v", parsed, pubKey)
+		}
+		if !bytes.Equal(parsed.SerializeCompressed(),
+			pubKey.SerializeCompressed()) ||
+			!bytes.Equal(parsed.SerializeUncompressed(),
+				pubKey.SerializeUncompressed()) {
+			t.Fatalf("serialization of %x does not round-trip",
+				serialized)
+		}
+	}
+
+	parsed, err := ParsePublicKeyHex(pubKey.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.IsEqual(&pubKey) {
+		t.Fatalf("parsed key %v, want %v", parsed, pubKey)
+	}
+
+	for _, serialized := range [][]byte{
+		nil,
+		pubKey.SerializeCompressed()[1:],
+		append([]byte{0x05}, pubKey.SerializeCompressed()[1:]...),
+	} {
+		if _, err := ParsePublicKey(serialized); err == nil {
+			t.Fatalf("parsed invalid key %x", serialized)
+		}
+	}
+	if _, err := ParsePublicKeyHex("not hex"); err == nil {
+		t.Fatalf("parsed invalid hex")
+	}
+}
+
+func TestPublicKeyVerify(t *testing.T) {
+	key, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey := (&PrivateKey{key}).PublicKey().(PublicKey)
+	hash := chainhash.HashB([]byte("message"))
+	sig, err := key.Sign(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := sig.Serialize()
+
+	if !pubKey.Verify(hash, signature) {
+		t.Fatalf("valid signature rejected")
+	}
+	if pubKey.Verify(chainhash.HashB([]byte("other")), signature) {
+		t.Fatalf("signature of another hash accepted")
+	}
+	if pubKey.Verify(hash, signature[1:]) {
+		t.Fatalf("malformed signature accepted")
+	}
+	otherKey, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPubKey := (&PrivateKey{otherKey}).PublicKey().(PublicKey)
+	if otherPubKey.Verify(hash, signature) {
+		t.Fatalf("signature verified by another key")
+	}
+}
+
+func TestPublicKeyAddress(t *testing.T) {
+	net := &Network{Net: &chaincfg.SimNetParams}
+	key, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	privKey := &PrivateKey{key}
+	pubKey := privKey.PublicKey().(PublicKey)
+
+	for _, addrType := range AddressTypes {
+		want, err := KeyAddress(privKey, addrType, net)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, err := pubKey.Address(addrType, net)
+		if addrType.SignatureType() == dcrec.STEd25519 {
+			if err == nil {
+				t.Fatalf("%v derived from the public key", addrType)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr.String() != want.String() {
+			t.Fatalf("%v %v, want %v", addrType, addr, want)
+		}
+	}
+
+	redeemScript, err := pubKey.RedeemScript()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantScript, err := KeyRedeemScript(privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(redeemScript, wantScript) {
+		t.Fatalf("redeem script %x, want %x", redeemScript, wantScript)
+	}
+}
+
+func TestLatencyPercentile(t *testing.T) {
+	report := &LoadReport{}
+	if got := report.LatencyPercentile(50); got != 0 {
+		t.Fatalf("percentile of no latencies %v, want 0", got)
+	}
+	for i := 1; i <= 10; i++ {
+		report.Latencies = append(report.Latencies,
+			time.Duration(i)*time.Millisecond)
+	}
+	tests := []struct {
+		percent float64
+		want    time.Duration
+	}{
+		{0, 1 * time.Millisecond},
+		{10, 1 * time.Millisecond},
+		{11, 2 * time.Millisecond},
+		{50, 5 * time.Millisecond},
+		{90, 9 * time.Millisecond},
+		{95, 10 * time.Millisecond},
+		{100, 10 * time.Millisecond},
+	}
+	for _, test := range tests {
+		got := report.LatencyPercentile(test.percent)
+		if got != test.want {
+			t.Errorf("percentile %v = %v, want %v", test.percent,
+				got, test.want)
+		}
+	}
+}
+
+func TestScheduledStakeVersion(t *testing.T) {
+	net := &chaincfg.SimNetParams
+	key, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	miningAddr, err := keyToAddr(key, net)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		stakeState *StakeState
+		entry      BlockVersionSchedule
+		want       StakeState
+	}{
+		{
+			name:  "no stake state",
+			entry: BlockVersionSchedule{Count: 1, BlockVersion: 6, StakeVersion: 5},
+			want:  StakeState{StakeVersion: 5},
+		},
+		{
+			name: "stake state kept",
+			stakeState: &StakeState{
+				VoteBits:     dcrutil.BlockValid,
+				SBits:        net.MinimumStakeDiff,
+				StakeVersion: 2,
+			},
+			entry: BlockVersionSchedule{Count: 1, BlockVersion: 6, StakeVersion: 7},
+			want: StakeState{
+				VoteBits:     dcrutil.BlockValid,
+				SBits:        net.MinimumStakeDiff,
+				StakeVersion: 7,
+			},
+		},
+		{
+			name: "unscheduled stake version",
+			stakeState: &StakeState{
+				StakeVersion: 3,
+			},
+			entry: BlockVersionSchedule{Count: 1, BlockVersion: 6},
+			want:  StakeState{StakeVersion: 3},
+		},
+	}
+	for _, test := range tests {
+		args := &GenerateBlockArgs{
+			MiningAddress: miningAddr,
+			Network:       net,
+			StakeState:    test.stakeState,
+		}
+		blockArgs, err := scheduledBlockArgs(nil, test.entry, args)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		block, err := CreateBlockWithArgs(nil, blockArgs)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		header := block.MsgBlock().Header
+		if header.Version != test.entry.BlockVersion {
+			t.Errorf("%s: block version %v, want %v", test.name,
+				header.Version, test.entry.BlockVersion)
+		}
+		if header.StakeVersion != test.want.StakeVersion ||
+			header.VoteBits != test.want.VoteBits ||
+			header.SBits != test.want.SBits {
+			t.Errorf("%s: header stake state %v/%v/%v, want %+v",
+				test.name, header.StakeVersion, header.VoteBits,
+				header.SBits, test.want)
+		}
+	}
+}
+
+// mempoolTestTx returns a mempool transaction of the passed size and fee
+// depending on the passed transactions, the lock time makes it unique.
+func mempoolTestTx(id uint32, size int, fee int64, depends ...*MempoolTx) *MempoolTx {
+	tx := wire.NewMsgTx()
+	tx.LockTime = id
+	mempoolTx := &MempoolTx{
+		Tx:   dcrutil.NewTx(tx),
+		Fee:  fee,
+		Size: size,
+	}
+	for _, depend := range depends {
+		mempoolTx.Depends = append(mempoolTx.Depends, depend.Tx.Hash())
+	}
+	return mempoolTx
+}
+
+func TestSelectMempoolTxns(t *testing.T) {
+	parent := mempoolTestTx(1, 1000, 1000)
+	child := mempoolTestTx(2, 1000, 100000, parent)
+	grandchild := mempoolTestTx(3, 1000, 100000, child)
+	rich := mempoolTestTx(4, 1000, 50000)
+	unknown := mempoolTestTx(5, 1000, 1000)
+	orphan := mempoolTestTx(6, 1000, 100000, unknown)
+	orphanChild := mempoolTestTx(7, 1000, 100000, orphan)
+	big := mempoolTestTx(8, 3000, 1000000)
+
+	tests := []struct {
+		name    string
+		txns    []*MempoolTx
+		maxSize int
+		want    []*MempoolTx
+	}{
+		{
+			name:    "parents first",
+			txns:    []*MempoolTx{grandchild, child, parent, rich},
+			maxSize: 10000,
+			want:    []*MempoolTx{rich, parent, child, grandchild},
+		},
+		{
+			name:    "size cutoff skips dependers",
+			txns:    []*MempoolTx{grandchild, child, parent, rich},
+			maxSize: 1999,
+			want:    []*MempoolTx{rich},
+		},
+		{
+			name:    "size cutoff at the limit",
+			txns:    []*MempoolTx{grandchild, child, parent, rich},
+			maxSize: 3000,
+			want:    []*MempoolTx{rich, parent, child},
+		},
+		{
+			name:    "oversize transaction skipped",
+			txns:    []*MempoolTx{big, rich},
+			maxSize: 2000,
+			want:    []*MempoolTx{rich},
+		},
+		{
+			name:    "unknown parent",
+			txns:    []*MempoolTx{orphanChild, orphan, rich},
+			maxSize: 10000,
+			want:    []*MempoolTx{rich},
+		},
+	}
+	for _, test := range tests {
+		selected := SelectMempoolTxns(test.txns, test.maxSize)
+		if len(selected) != len(test.want) {
+			t.Errorf("%s: selected %v transactions, want %v",
+				test.name, len(selected), len(test.want))
+			continue
+		}
+		for i, tx := range selected {
+			if *tx.Hash() != *test.want[i].Tx.Hash() {
+				t.Errorf("%s: transaction %v is %v, want lock "+
+					"time %v", test.name, i,
+					tx.MsgTx().LockTime,
+					test.want[i].Tx.MsgTx().LockTime)
+			}
+		}
+	}
+}
+
+// stakeVersionHistory returns the stake versions of a chain ending at the
+// passed height ordered from the tip backwards as getstakeversions does. Every
+// block carries the passed block and stake versions, the votes from the stake
+// validation height on are cast with the versions returned by vote.
+func stakeVersionHistory(net *chaincfg.Params, tipHeight int64, blockVersion int32, stakeVersion uint32, vote func(height int64, index uint16) uint32) []dcrjson.StakeVersions {
+	history := make([]dcrjson.StakeVersions, 0, tipHeight+1)
+	for height := tipHeight; height >= 0; height-- {
+		entry := dcrjson.StakeVersions{
+			Height:       height,
+			BlockVersion: blockVersion,
+			StakeVersion: stakeVersion,
+		}
+		if height >= net.StakeValidationHeight {
+			for i := uint16(0); i < net.TicketsPerBlock; i++ {
+				entry.Votes = append(entry.Votes,
+					dcrjson.VersionBits{Version: vote(height, i)})
+			}
+		}
+		history = append(history, entry)
+	}
+	return history
+}
+
+func TestCalcNextStakeVersionWindow(t *testing.T) {
+	net := &chaincfg.SimNetParams
+	svh := net.StakeValidationHeight
+	svi := net.StakeVersionInterval
+	window := stakeVersionWindow(net)
+	// Every interval has a majority of the votes on version 5.
+	majority := func(int64, uint16) uint32 {
+		return 5
+	}
+	// Only the first interval has a majority, the votes of the later ones
+	// are split between versions 5 and 6.
+	firstOnly := func(height int64, index uint16) uint32 {
+		if height < svh+svi || index%2 == 0 {
+			return 5
+		}
+		return 6
+	}
+	for tipHeight := svh; tipHeight < svh+6*svi; tipHeight++ {
+		history := stakeVersionHistory(net, tipHeight, 7, 0, majority)
+		want, err := CalcNextStakeVersion(history, net)
+		if err != nil {
+			t.Fatalf("tip %v: %v", tipHeight, err)
+		}
+		if int64(len(history)) > window {
+			history = history[:window]
+		}
+		got, err := CalcNextStakeVersion(history, net)
+		if err != nil || got != want {
+			t.Fatalf("tip %v: window stake version %v, %v, want %v",
+				tipHeight, got, err, want)
+		}
+
+		history = stakeVersionHistory(net, tipHeight, 7, 0, firstOnly)
+		if _, err := CalcNextStakeVersion(history, net); err != nil {
+			t.Fatalf("tip %v: %v", tipHeight, err)
+		}
+		if int64(len(history)) <= window ||
+			tipHeight < svh+3*svi+int64(net.BlockUpgradeNumToCheck) {
+			continue
+		}
+		_, err = CalcNextStakeVersion(history[:window], net)
+		if _, missing := err.(missingStakeVersionsError); !missing {
+			t.Fatalf("tip %v: window without a majority returned "+
+				"%v, want missing stake versions", tipHeight, err)
+		}
+	}
+}
+
+// difficultyHeaders returns the headers of the passed range of heights with the
+// passed bits, each one timestamped with the seconds returned for its height.
+func difficultyHeaders(first, last int64, bits uint32, seconds func(height int64) int64) []*wire.BlockHeader {
+	var headers []*wire.BlockHeader
+	for height := first; height <= last; height++ {
+		headers = append(headers, &wire.BlockHeader{
+			Height:    uint32(height),
+			Bits:      bits,
+			Timestamp: time.Unix(1500000000+seconds(height), 0),
+		})
+	}
+	return headers
+}
+
+func TestCalcNextRequiredDifficulty(t *testing.T) {
+	simnet := &chaincfg.SimNetParams
+	testnet := &chaincfg.TestNet3Params
+	const bits = 0x1f00ffff
+	// scaled returns bits with the target scaled by num/den.
+	scaled := func(num, den int64) uint32 {
+		target := blockchain.CompactToBig(bits)
+		target.Mul(target, big.NewInt(num))
+		target.Div(target, big.NewInt(den))
+		return blockchain.BigToCompact(target)
+	}
+	every := func(spacing int64) func(int64) int64 {
+		return func(height int64) int64 {
+			return height * spacing
+		}
+	}
+	// The simnet retargets every 8 blocks over 4 windows, so the headers
+	// 31 to 63 cover the windows of the retarget of block 64.
+	retarget := func(timestamp func(int64) int64) []*wire.BlockHeader {
+		return difficultyHeaders(31, 63, bits, timestamp)
+	}
+	withBits := func(headers []*wire.BlockHeader, from int, bits uint32) []*wire.BlockHeader {
+		for _, header := range headers[from:] {
+			header.Bits = bits
+		}
+		return headers
+	}
+	tip := func(headers []*wire.BlockHeader) time.Time {
+		return headers[len(headers)-1].Timestamp
+	}
+
+	tests := []struct {
+		name     string
+		net      *chaincfg.Params
+		headers  []*wire.BlockHeader
+		newBlock time.Duration
+		want     uint32
+		wantErr  bool
+	}{
+		{
+			name:    "no retarget",
+			net:     simnet,
+			headers: withBits(retarget(every(100))[:32], 31, 0x1f00fffe),
+			want:    0x1f00fffe,
+		},
+		{
+			name:    "retarget on target",
+			net:     simnet,
+			headers: retarget(every(1)),
+			want:    bits,
+		},
+		{
+			name:    "retarget twice as slow",
+			net:     simnet,
+			headers: retarget(every(2)),
+			want:    scaled(2, 1),
+		},
+		{
+			name: "retarget twice as fast",
+			net:  simnet,
+			headers: retarget(func(height int64) int64 {
+				return height / 2
+			}),
+			want: scaled(1, 2),
+		},
+		{
+			name:    "retarget limited when slow",
+			net:     simnet,
+			headers: retarget(every(100)),
+			want:    scaled(4, 1),
+		},
+		{
+			name: "retarget limited when fast",
+			net:  simnet,
+			headers: retarget(func(height int64) int64 {
+				return height / 8
+			}),
+			want: scaled(1, 4),
+		},
+		{
+			name:    "retarget limited by the pow limit",
+			net:     simnet,
+			headers: withBits(retarget(every(100)), 0, simnet.PowLimitBits),
+			want:    simnet.PowLimitBits,
+		},
+		{
+			name:    "windows before the genesis block",
+			net:     simnet,
+			headers: difficultyHeaders(0, 7, bits, every(100)),
+			want:    bits,
+		},
+		{
+			name:    "not enough headers",
+			net:     simnet,
+			headers: retarget(every(1))[1:],
+			wantErr: true,
+		},
+		{
+			name:     "testnet within the reduction time",
+			net:      testnet,
+			headers:  difficultyHeaders(0, 10, bits, every(120)),
+			newBlock: testnet.MinDiffReductionTime,
+			want:     bits,
+		},
+		{
+			name:     "testnet after the reduction time",
+			net:      testnet,
+			headers:  difficultyHeaders(0, 10, bits, every(120)),
+			newBlock: testnet.MinDiffReductionTime + time.Second,
+			want:     testnet.PowLimitBits,
+		},
+		{
+			name: "testnet after minimum difficulty blocks",
+			net:  testnet,
+			headers: withBits(difficultyHeaders(0, 10, bits,
+				every(120)), 8, testnet.PowLimitBits),
+			newBlock: time.Second,
+			want:     bits,
+		},
+	}
+	for _, test := range tests {
+		got, err := CalcNextRequiredDifficulty(test.headers,
+			tip(test.headers).Add(test.newBlock), test.net)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: bits %08x, want %08x", test.name, got,
+				test.want)
+		}
+	}
+}
+
+func TestChainBuilderReproducible(t *testing.T) {
+	build := func(extraNonceSeed int64) []*dcrutil.Block {
+		builder, err := NewChainBuilder(&ChainBuilderArgs{
+			Network:      &chaincfg.SimNetParams,
+			BlockVersion: CurrentBlockVersion,
+			Seed:         NewTestSeed(0),
+			SpendOutputs: 2,
+			ExtraNonce:   NewSeededExtraNonceSource(extraNonceSeed),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The chain reaches past the stake enabled height, so it
+		// carries ticket purchases as well.
+		count := int(chaincfg.SimNetParams.StakeEnabledHeight) + 8
+		if err := builder.Generate(count); err != nil {
+			t.Fatal(err)
+		}
+		return builder.Blocks()
+	}
+
+	first, second, other := build(1), build(1), build(2)
+	if len(first) != len(second) {
+		t.Fatalf("chains have %v and %v blocks", len(first), len(second))
+	}
+	for i, block := range first {
+		if *block.Hash() != *second[i].Hash() {
+			t.Fatalf("block %v hashes %v and %v differ", block.Height(),
+				block.Hash(), second[i].Hash())
+		}
+	}
+	// Block one pays the ledger without an extranonce, so the chains of
+	// different seeds only differ from block two on.
+	tip := len(first) - 1
+	if *first[tip].Hash() == *other[tip].Hash() {
+		t.Fatalf("chains of different extranonce seeds share block %v",
+			first[tip].Hash())
+	}
+}
+
+func TestSeededExtraNonceSource(t *testing.T) {
+	draw := func(source ExtraNonceSource, count int) []uint64 {
+		var nonces []uint64
+		for i := 0; i < count; i++ {
+			nonce, err := source.NextExtraNonce()
+			if err != nil {
+				t.Fatal(err)
+			}
+			nonces = append(nonces, nonce)
+		}
+		return nonces
+	}
+	const count = 16
+	want := draw(NewSeededExtraNonceSource(1), count)
+
+	if got := draw(NewSeededExtraNonceSource(1), count); !reflect.DeepEqual(got, want) {
+		t.Fatalf("same seed extranonces %v, want %v", got, want)
+	}
+	if got := draw(NewSeededExtraNonceSource(2), count); reflect.DeepEqual(got, want) {
+		t.Fatalf("different seeds share extranonces %v", got)
+	}
+
+	// Concurrent users of a source get the extranonces of the sequence in
+	// no particular order.
+	source := NewSeededExtraNonceSource(1)
+	results := make(chan uint64, count)
+	for i := 0; i < count; i++ {
+		go func() {
+			nonce, _ := source.NextExtraNonce()
+			results <- nonce
+		}()
+	}
+	drawn := make(map[uint64]int)
+	for i := 0; i < count; i++ {
+		drawn[<-results]++
+	}
+	for _, nonce := range want {
+		drawn[nonce]--
+	}
+	for nonce, n := range drawn {
+		if n != 0 {
+			t.Fatalf("extranonce %v drawn concurrently %v times more "+
+				"than in the sequence", nonce, n)
+		}
+	}
+}
+
+func TestCoinbaseExtraNonce(t *testing.T) {
+	const seed = 3
+	builder, err := NewChainBuilder(&ChainBuilderArgs{
+		Network:      &chaincfg.SimNetParams,
+		BlockVersion: CurrentBlockVersion,
+		Seed:         NewTestSeed(0),
+		ExtraNonce:   NewSeededExtraNonceSource(seed),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.Generate(4); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every block draws an extranonce, block one pays the ledger without
+	// encoding it.
+	sequence := NewSeededExtraNonceSource(seed)
+	for _, block := range builder.Blocks() {
+		want, _ := sequence.NextExtraNonce()
+		msgBlock := block.MsgBlock()
+		if block.Height() == 1 {
+			if got := coinbaseExtraNonce(msgBlock); got != 0 {
+				t.Fatalf("block one extranonce %v, want none", got)
+			}
+			continue
+		}
+		if got := coinbaseExtraNonce(msgBlock); got != want {
+			t.Fatalf("block %v extranonce %v, want %v",
+				block.Height(), got, want)
+		}
+
+		merkleRoot := msgBlock.Header.MerkleRoot
+		if err := updateExtraNonce(msgBlock, want+1); err != nil {
+			t.Fatal(err)
+		}
+		if got := coinbaseExtraNonce(msgBlock); got != want+1 {
+			t.Fatalf("block %v updated extranonce %v, want %v",
+				block.Height(), got, want+1)
+		}
+		if msgBlock.Header.MerkleRoot == merkleRoot {
+			t.Fatalf("block %v merkle root did not follow the "+
+				"extranonce", block.Height())
+		}
+	}
+}
+
+func TestDustThreshold(t *testing.T) {
+	addr, err := dcrutil.NewAddressPubKeyHash(make([]byte, 20),
+		&chaincfg.SimNetParams, dcrec.STEcdsaSecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkScript, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name          string
+		pkScript      []byte
+		minRelayTxFee dcrutil.Amount
+		want          int64
+	}{
+		// 36 bytes of the output and 165 of the redeeming input cost
+		// 3 * 201 * 10000 / 1000 atoms.
+		{"pay-to-pubkey-hash", pkScript, DefaultMinRelayTxFee, 6030},
+		{"doubled fee rate", pkScript, 2 * DefaultMinRelayTxFee, 12060},
+		{"rounded up", pkScript, 1, 1},
+		{"one byte script", []byte{txscript.OP_TRUE},
+			DefaultMinRelayTxFee, 5310},
+	}
+	for _, test := range tests {
+		txOut := wire.NewTxOut(0, test.pkScript)
+		if got := DustThreshold(txOut, test.minRelayTxFee); got != test.want {
+			t.Errorf("%s: threshold %v, want %v", test.name, got,
+				test.want)
+		}
+	}
+}
+
+func TestValidateCoinbaseOutputs(t *testing.T) {
+	net := &chaincfg.SimNetParams
+	addr, err := dcrutil.NewAddressPubKeyHash(make([]byte, 20), net,
+		dcrec.STEcdsaSecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkScript, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nullData := []byte{txscript.OP_RETURN}
+	nonStandard := []byte{txscript.OP_TRUE}
+	const preSVH = 100
+	svh := net.StakeValidationHeight
+	work, _ := CalcCoinbaseSubsidy(preSVH, 0, net)
+	// Three of the five votes reduce the subsidy and the fees.
+	penalizedWork, _ := CalcCoinbaseSubsidy(svh, 3, net)
+
+	tests := []struct {
+		name      string
+		mineTo    []wire.TxOut
+		height    int64
+		voters    uint16
+		fees      int64
+		policy    *CoinbasePolicy
+		violation CoinbaseViolation
+		index     int
+		limit     int64
+		valid     bool
+	}{
+		{
+			name:   "subsidy and fees",
+			mineTo: []wire.TxOut{{Value: work + 1000, PkScript: pkScript}},
+			height: preSVH,
+			fees:   1000,
+			valid:  true,
+		},
+		{
+			name:      "one atom over",
+			mineTo:    []wire.TxOut{{Value: work + 1001, PkScript: pkScript}},
+			height:    preSVH,
+			fees:      1000,
+			violation: CoinbaseOverpays,
+			index:     -1,
+			limit:     work + 1000,
+		},
+		{
+			name:   "penalized fees",
+			mineTo: []wire.TxOut{{Value: penalizedWork + 599, PkScript: pkScript}},
+			height: svh,
+			voters: 3,
+			fees:   999,
+			valid:  true,
+		},
+		{
+			name:      "one atom over penalized fees",
+			mineTo:    []wire.TxOut{{Value: penalizedWork + 600, PkScript: pkScript}},
+			height:    svh,
+			voters:    3,
+			fees:      999,
+			violation: CoinbaseOverpays,
+			index:     -1,
+			limit:     penalizedWork + 599,
+		},
+		{
+			name: "dust threshold",
+			mineTo: []wire.TxOut{
+				{Value: work - 6030, PkScript: pkScript},
+				{Value: 6030, PkScript: pkScript},
+			},
+			height: preSVH,
+			valid:  true,
+		},
+		{
+			name: "one atom below the dust threshold",
+			mineTo: []wire.TxOut{
+				{Value: work - 6029, PkScript: pkScript},
+				{Value: 6029, PkScript: pkScript},
+			},
+			height:    preSVH,
+			violation: CoinbaseDustOutput,
+			index:     1,
+			limit:     6030,
+		},
+		{
+			name: "zero value null data",
+			mineTo: []wire.TxOut{
+				{Value: work, PkScript: pkScript},
+				{PkScript: nullData},
+			},
+			height: preSVH,
+			valid:  true,
+		},
+		{
+			name:      "null data locking a value",
+			mineTo:    []wire.TxOut{{Value: 1, PkScript: nullData}},
+			height:    preSVH,
+			violation: CoinbaseUnspendableValue,
+		},
+		{
+			name:      "negative value",
+			mineTo:    []wire.TxOut{{Value: -1, PkScript: pkScript}},
+			height:    preSVH,
+			violation: CoinbaseNegativeValue,
+		},
+		{
+			name:      "empty script",
+			mineTo:    []wire.TxOut{{Value: work}},
+			height:    preSVH,
+			violation: CoinbaseEmptyScript,
+		},
+		{
+			name:      "non-standard script",
+			mineTo:    []wire.TxOut{{Value: work, PkScript: nonStandard}},
+			height:    preSVH,
+			violation: CoinbaseNonStandardScript,
+		},
+		{
+			name:   "allowed non-standard script",
+			mineTo: []wire.TxOut{{Value: work, PkScript: nonStandard}},
+			height: preSVH,
+			policy: &CoinbasePolicy{AllowNonStandard: true},
+			valid:  true,
+		},
+	}
+	for _, test := range tests {
+		err := ValidateCoinbaseOutputs(test.mineTo, test.height,
+			test.voters, test.fees, test.policy, net)
+		if test.valid {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			continue
+		}
+		outputError, ok := err.(*CoinbaseOutputError)
+		if !ok {
+			t.Errorf("%s: error %v, want %v", test.name, err,
+				test.violation)
+			continue
+		}
+		if outputError.Violation != test.violation ||
+			outputError.Index != test.index ||
+			outputError.Limit != test.limit {
+			t.Errorf("%s: %v of output %v limited to %v, want %v of "+
+				"output %v limited to %v", test.name,
+				outputError.Violation, outputError.Index,
+				outputError.Limit, test.violation, test.index,
+				test.limit)
+		}
+	}
+}
+
+func TestCalcPastMedianTime(t *testing.T) {
+	// timestamped returns the headers of the heights starting at the
+	// passed one with the passed timestamps in seconds.
+	timestamped := func(first int64, seconds ...int64) []*wire.BlockHeader {
+		return difficultyHeaders(first, first+int64(len(seconds))-1, 0,
+			func(height int64) int64 {
+				return seconds[height-first]
+			})
+	}
+	tests := []struct {
+		name    string
+		headers []*wire.BlockHeader
+		want    int64
+		wantErr bool
+	}{
+		{
+			name:    "genesis block only",
+			headers: timestamped(0, 10),
+			want:    10,
+		},
+		{
+			// The upper of the middle timestamps is picked, as the
+			// consensus rules do.
+			name:    "even number of blocks",
+			headers: timestamped(0, 10, 20, 30, 40),
+			want:    30,
+		},
+		{
+			name:    "odd number of blocks",
+			headers: timestamped(0, 10, 20, 30, 40, 50),
+			want:    30,
+		},
+		{
+			name:    "unordered timestamps",
+			headers: timestamped(0, 40, 10, 30, 20),
+			want:    30,
+		},
+		{
+			name: "last blocks only",
+			headers: timestamped(5, 1000, 1, 2, 3, 4, 5, 6, 7, 8,
+				9, 10, 11),
+			want: 6,
+		},
+		{
+			name:    "not enough headers",
+			headers: timestamped(5, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10),
+			wantErr: true,
+		},
+		{
+			name:    "no headers",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		got, err := CalcPastMedianTime(test.headers)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if want := time.Unix(1500000000+test.want, 0); !got.Equal(want) {
+			t.Errorf("%s: median time %v, want %v", test.name, got,
+				want)
+		}
+	}
+}
+
+func TestCalcNextStakeVersionMajority(t *testing.T) {
+	net := &chaincfg.SimNetParams
+	svh := net.StakeValidationHeight
+	svi := net.StakeVersionInterval
+	perInterval := svi * int64(net.TicketsPerBlock)
+	// required is the number of the votes of an interval making a
+	// majority, 420 of the 560 simnet votes.
+	required := perInterval * int64(net.StakeMajorityMultiplier) /
+		int64(net.StakeMajorityDivisor)
+	// votes casts the first count votes of every interval for version,
+	// the rest for version 4.
+	votes := func(count int64, version uint32) func(int64, uint16) uint32 {
+		return func(height int64, index uint16) uint32 {
+			position := (height-svh)%svi*int64(net.TicketsPerBlock) +
+				int64(index)
+			if position < count {
+				return version
+			}
+			return 4
+		}
+	}
+	tests := []struct {
+		name         string
+		tipHeight    int64
+		blockVersion int32
+		stakeVersion uint32
+		vote         func(int64, uint16) uint32
+		want         uint32
+	}{
+		{
+			name:         "before the first interval",
+			tipHeight:    svh + svi - 2,
+			blockVersion: 7,
+			vote:         votes(perInterval, 5),
+			want:         0,
+		},
+		{
+			name:         "majority",
+			tipHeight:    svh + svi - 1,
+			blockVersion: 7,
+			vote:         votes(required, 5),
+			want:         5,
+		},
+		{
+			name:         "one vote short of a majority",
+			tipHeight:    svh + svi - 1,
+			blockVersion: 7,
+			vote:         votes(required-1, 5),
+			want:         0,
+		},
+		{
+			name:         "other version majority",
+			tipHeight:    svh + svi - 1,
+			blockVersion: 7,
+			vote:         votes(perInterval-required, 5),
+			want:         4,
+		},
+		{
+			name:         "old block versions",
+			tipHeight:    svh + svi - 1,
+			blockVersion: 2,
+			vote:         votes(required, 5),
+			want:         0,
+		},
+		{
+			name:         "majority of an earlier interval",
+			tipHeight:    svh + 2*svi - 1,
+			blockVersion: 7,
+			vote: func(height int64, index uint16) uint32 {
+				if height < svh+svi {
+					return 5
+				}
+				return votes(required-1, 5)(height, index)
+			},
+			want: 5,
+		},
+		{
+			name:         "locked in by the prior headers",
+			tipHeight:    svh + 2*svi - 1,
+			blockVersion: 7,
+			stakeVersion: 5,
+			vote:         votes(perInterval, 4),
+			want:         5,
+		},
+		{
+			name:         "not locked in by the prior headers",
+			tipHeight:    svh + 2*svi - 1,
+			blockVersion: 7,
+			stakeVersion: 3,
+			vote:         votes(perInterval, 4),
+			want:         4,
+		},
+	}
+	for _, test := range tests {
+		history := stakeVersionHistory(net, test.tipHeight,
+			test.blockVersion, test.stakeVersion, test.vote)
+		got, err := CalcNextStakeVersion(history, net)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: stake version %v, want %v", test.name, got,
+				test.want)
+		}
+	}
+}
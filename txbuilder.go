@@ -0,0 +1,337 @@
+package btcharness
+
+import (
+	"fmt"
+
+	"github.com/jfixby/coin"
+	"github.com/jfixby/coinharness"
+	"github.com/picfight/pfcd/chaincfg"
+	"github.com/picfight/pfcd/dcrutil"
+	"github.com/picfight/pfcd/txscript"
+	"github.com/picfight/pfcd/wire"
+)
+
+// maxFeeIterations bounds the number of times TxBuilder re-signs the
+// transaction while the size of the signatures settles the fee.
+const maxFeeIterations = 10
+
+// TxBuilder assembles, funds and signs a transaction. Every method returns the
+// builder so the calls can be chained, the first error is reported by Build():
+//
+//	tx, err := NewTxBuilder(net).
+//		AddInput(outPoint, prevOut).
+//		PayToAddress(addr, amount).
+//		ChangeAddress(change).
+//		SignWith(key).
+//		Build()
+type TxBuilder struct {
+	err error
+
+	inputs   []*builderInput
+	outputs  []*wire.TxOut
+	ring     *KeyRing
+	feePerKB int64
+	change   dcrutil.Address
+	version  uint16
+	lockTime uint32
+	expiry   uint32
+}
+
+// builderInput is an output spent by TxBuilder
+type builderInput struct {
+	output   *SpendableOutput
+	sequence uint32
+
+	// signer builds the signature script of the input, nil means the
+	// KeyRing of the builder signs it
+	signer ScriptSigner
+}
+
+// BuiltTx is a transaction produced by TxBuilder
+type BuiltTx struct {
+	Tx *coinharness.MessageTx
+
+	// Fee paid by the transaction, the difference between the values spent
+	// and paid
+	Fee coin.Amount
+
+	// Size of the serialized transaction as reported by TxSerializeSize()
+	Size int
+
+	// ChangeIndex is the index of the change output or -1 when the
+	// transaction has none
+	ChangeIndex int
+}
+
+// NewTxBuilder creates a TxBuilder for the passed network paying
+// DefaultMinRelayTxFee per kilobyte.
+func NewTxBuilder(net coinharness.Network) *TxBuilder {
+	return &TxBuilder{
+		ring:     NewKeyRing(net.Params().(*chaincfg.Params)),
+		feePerKB: int64(DefaultMinRelayTxFee),
+		version:  wire.TxVersion,
+	}
+}
+
+// fail records the first error of the chain of calls.
+func (b *TxBuilder) fail(err error) *TxBuilder {
+	if b.err == nil {
+		b.err = err
+	}
+	return b
+}
+
+// AddInput spends the passed outpoint of a transaction output. The location of
+// the output in the chain is unknown, so the fraud proof of the input is left
+// null, which the node fills in when it mines the transaction. Transactions
+// placed directly in blocks have to spend outputs added with
+// AddSpendableOutput instead.
+func (b *TxBuilder) AddInput(outPoint coinharness.OutPoint, prevOut *coinharness.TxOut) *TxBuilder {
+	hash, err := HashToRaw(outPoint.Hash)
+	if err != nil {
+		return b.fail(err)
+	}
+	return b.AddSpendableOutput(&SpendableOutput{
+		OutPoint:    *wire.NewOutPoint(&hash, outPoint.Index, outPoint.Tree),
+		Value:       prevOut.Value.ToAtoms(),
+		PkScript:    prevOut.PkScript,
+		BlockHeight: wire.NullBlockHeight,
+		BlockIndex:  wire.NullBlockIndex,
+	})
+}
+
+// AddSpendableOutput spends the passed output.
+func (b *TxBuilder) AddSpendableOutput(output *SpendableOutput) *TxBuilder {
+	return b.AddScriptInput(output, wire.MaxTxInSequenceNum, nil)
+}
+
+// AddScriptInput spends the passed output with an input of the passed sequence
+// number whose signature script is built by the signer. A nil signer signs
+// the input with the keys and the scripts of the builder.
+func (b *TxBuilder) AddScriptInput(output *SpendableOutput, sequence uint32, signer ScriptSigner) *TxBuilder {
+	b.inputs = append(b.inputs, &builderInput{
+		output:   output,
+		sequence: sequence,
+		signer:   signer,
+	})
+	return b
+}
+
+// PayToAddress adds an output paying the amount to the passed address.
+func (b *TxBuilder) PayToAddress(addr coinharness.Address, amount coin.Amount) *TxBuilder {
+	pkScript, err := PayToAddrScript(addr)
+	if err != nil {
+		return b.fail(err)
+	}
+	return b.PayToScript(pkScript, amount)
+}
+
+// PayToScript adds an output paying the amount to the passed public key script.
+func (b *TxBuilder) PayToScript(pkScript []byte, amount coin.Amount) *TxBuilder {
+	b.outputs = append(b.outputs, wire.NewTxOut(amount.ToAtoms(), pkScript))
+	return b
+}
+
+// FeeRate sets the fee paid per kilobyte of the serialized transaction.
+func (b *TxBuilder) FeeRate(feePerKB coin.Amount) *TxBuilder {
+	b.feePerKB = feePerKB.ToAtoms()
+	return b
+}
+
+// ChangeAddress sets the address receiving the value spent in excess of the
+// outputs and the fee. Without a change address the whole excess is the fee.
+func (b *TxBuilder) ChangeAddress(addr coinharness.Address) *TxBuilder {
+	b.change = addr.Internal().(dcrutil.Address)
+	return b
+}
+
+// Version sets the version of the transaction, relative lock times enforced by
+// OP_CHECKSEQUENCEVERIFY require version 2.
+func (b *TxBuilder) Version(version uint16) *TxBuilder {
+	b.version = version
+	return b
+}
+
+// LockTime sets the lock time of the transaction.
+func (b *TxBuilder) LockTime(lockTime uint32) *TxBuilder {
+	b.lockTime = lockTime
+	return b
+}
+
+// Expiry sets the height after which the transaction can not be mined.
+func (b *TxBuilder) Expiry(expiry uint32) *TxBuilder {
+	b.expiry = expiry
+	return b
+}
+
+// SignWith adds the passed key to the keys signing the inputs, it unlocks the
+// outputs paying to any AddressType derived from the key.
+func (b *TxBuilder) SignWith(key coinharness.PrivateKey) *TxBuilder {
+	if err := b.ring.AddKeyAddresses(key.(*PrivateKey).legacy); err != nil {
+		return b.fail(err)
+	}
+	return b
+}
+
+// SignWithKeyRing replaces the keys and the scripts signing the inputs with the
+// passed KeyRing, the ones added later are added to it.
+func (b *TxBuilder) SignWithKeyRing(ring *KeyRing) *TxBuilder {
+	b.ring = ring
+	return b
+}
+
+// SignWithExtendedKey adds the private keys of the children at the passed
+// indexes of the extended key to the keys signing the inputs, or the private
+// key of the extended key itself when no index is passed.
+func (b *TxBuilder) SignWithExtendedKey(key coinharness.ExtendedKey, indexes ...uint32) *TxBuilder {
+	if len(indexes) == 0 {
+		privKey, err := key.PrivateKey()
+		if err != nil {
+			return b.fail(err)
+		}
+		return b.SignWith(privKey)
+	}
+	for _, index := range indexes {
+		child, err := key.Child(index)
+		if err != nil {
+			return b.fail(err)
+		}
+		privKey, err := child.PrivateKey()
+		if err != nil {
+			return b.fail(err)
+		}
+		b.SignWith(privKey)
+	}
+	return b
+}
+
+// SignWithScript adds the passed redeem script to the scripts used to sign the
+// inputs spending pay-to-script-hash outputs.
+func (b *TxBuilder) SignWithScript(redeemScript []byte) *TxBuilder {
+	if _, err := b.ring.AddScript(redeemScript); err != nil {
+		return b.fail(err)
+	}
+	return b
+}
+
+// Build signs the transaction and returns it. When a change address is set,
+// a change output receives the excess value unless it would be dust. An error
+// is returned when the transaction can't pay the fee rate.
+func (b *TxBuilder) Build() (*BuiltTx, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if len(b.inputs) == 0 {
+		return nil, fmt.Errorf("transaction has no inputs")
+	}
+
+	var totalIn, totalOut int64
+	for _, input := range b.inputs {
+		totalIn += input.output.Value
+	}
+	for _, output := range b.outputs {
+		totalOut += output.Value
+	}
+	if totalOut > totalIn {
+		return nil, fmt.Errorf("outputs pay %v, more than the %v spent",
+			dcrutil.Amount(totalOut), dcrutil.Amount(totalIn))
+	}
+
+	tx := wire.NewMsgTx()
+	tx.Version = b.version
+	tx.LockTime = b.lockTime
+	tx.Expiry = b.expiry
+	for _, input := range b.inputs {
+		txIn := input.output.TxIn()
+		txIn.Sequence = input.sequence
+		tx.AddTxIn(txIn)
+	}
+	for _, output := range b.outputs {
+		tx.AddTxOut(output)
+	}
+	if b.change == nil {
+		if err := b.sign(tx); err != nil {
+			return nil, err
+		}
+		fee := totalIn - totalOut
+		required := b.feePerKB * int64(tx.SerializeSize()) / 1000
+		if fee < required {
+			return nil, fmt.Errorf("inputs spend %v, not enough to pay "+
+				"%v and the fee %v", dcrutil.Amount(totalIn),
+				dcrutil.Amount(totalOut), dcrutil.Amount(required))
+		}
+		return builtTx(tx, fee, -1), nil
+	}
+
+	changeScript, err := txscript.PayToAddrScript(b.change)
+	if err != nil {
+		return nil, err
+	}
+	changeOut := wire.NewTxOut(0, changeScript)
+	tx.AddTxOut(changeOut)
+	fee := int64(0)
+	settled := false
+	for i := 0; i < maxFeeIterations; i++ {
+		changeOut.Value = totalIn - totalOut - fee
+		if changeOut.Value < 0 {
+			return nil, fmt.Errorf("inputs spend %v, not enough to pay "+
+				"%v and the fee %v", dcrutil.Amount(totalIn),
+				dcrutil.Amount(totalOut), dcrutil.Amount(fee))
+		}
+		if err := b.sign(tx); err != nil {
+			return nil, err
+		}
+		required := b.feePerKB * int64(tx.SerializeSize()) / 1000
+		if required <= fee {
+			settled = true
+			break
+		}
+		fee = required
+	}
+	if !settled {
+		return nil, fmt.Errorf("fee did not settle after %v signing "+
+			"iterations, last fee %v", maxFeeIterations,
+			dcrutil.Amount(fee))
+	}
+	if changeOut.Value < DustThreshold(changeOut, DefaultMinRelayTxFee) {
+		tx.TxOut = tx.TxOut[:len(tx.TxOut)-1]
+		if err := b.sign(tx); err != nil {
+			return nil, err
+		}
+		return builtTx(tx, totalIn-totalOut, -1), nil
+	}
+	return builtTx(tx, fee, len(tx.TxOut)-1), nil
+}
+
+// sign signs every input of the transaction.
+func (b *TxBuilder) sign(tx *wire.MsgTx) error {
+	for _, txIn := range tx.TxIn {
+		txIn.SignatureScript = nil
+	}
+	for i, input := range b.inputs {
+		if input.signer == nil {
+			err := b.ring.SignInput(tx, i, input.output.PkScript)
+			if err != nil {
+				return fmt.Errorf("failed to sign input %v: %v",
+					i, err)
+			}
+			continue
+		}
+		sigScript, err := input.signer(TransactionRawToTx(tx), i)
+		if err != nil {
+			return fmt.Errorf("failed to sign input %v: %v", i, err)
+		}
+		tx.TxIn[i].SignatureScript = sigScript
+	}
+	return nil
+}
+
+func builtTx(tx *wire.MsgTx, fee int64, changeIndex int) *BuiltTx {
+	msgTx := TransactionRawToTx(tx)
+	return &BuiltTx{
+		Tx:          msgTx,
+		Fee:         coin.Amount{AtomsValue: fee},
+		Size:        tx.SerializeSize(),
+		ChangeIndex: changeIndex,
+	}
+}
@@ -0,0 +1,255 @@
+package btcharness
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/jfixby/coinharness"
+	"github.com/jfixby/pin"
+	"github.com/picfight/pfcd/chaincfg/chainhash"
+	"github.com/picfight/pfcd/dcrutil"
+	"github.com/picfight/pfcd/txscript"
+	"github.com/picfight/pfcd/wire"
+)
+
+// SubmitOrder is the order SubmitTxTree() sends the transactions of a tree in
+type SubmitOrder int
+
+const (
+	// ParentsFirst sends every transaction after the transactions it
+	// spends from, level by level
+	ParentsFirst SubmitOrder = iota
+
+	// ChildrenFirst sends the deepest level first, so every transaction
+	// but the ones spending the root is an orphan when it is sent
+	ChildrenFirst
+
+	// Shuffled sends the transactions in a random order
+	Shuffled
+)
+
+// TxTreeArgs bundles NewTxTree() arguments to minimize diff
+// in case a new argument for the function is added
+type TxTreeArgs struct {
+	// Root is the confirmed output funding the tree, for example one of
+	// FetchMemWalletOutputs()
+	Root *SpendableOutput
+
+	// KeyRing holds the keys of the Root and of the PayTo address
+	KeyRing *KeyRing
+
+	// PayTo receives the outputs of every transaction of the tree
+	PayTo dcrutil.Address
+
+	// Depth is the number of levels of the tree
+	Depth int
+
+	// FanOut is the number of outputs of every transaction, each of them
+	// is spent by a transaction of the next level. A fan-out of 1 builds
+	// a chain.
+	FanOut int
+
+	// LevelFees are the fees paid by each transaction of a level, the
+	// last entry applies to the deeper levels. Fees below
+	// DefaultMinRelayTxFee for the size of the transaction, zero included,
+	// are raised to it.
+	LevelFees []int64
+
+	// AllowLowFees keeps the nonzero LevelFees below the relay minimum,
+	// for example to test the rejection of low fee transactions
+	AllowLowFees bool
+}
+
+// TreeTx is a transaction of an unconfirmed transaction tree
+type TreeTx struct {
+	Tx   *wire.MsgTx
+	Hash *chainhash.Hash
+
+	// Level is the depth of the transaction in the tree, the transaction
+	// spending the root is at level 0
+	Level int
+
+	// Parent is the index of the transaction spent from in the tree,
+	// -1 for the transaction spending the root
+	Parent int
+
+	Fee int64
+}
+
+// TxTreeSubmission reports the outcome of sending a transaction of a tree
+type TxTreeSubmission struct {
+	// Index of the transaction in the tree
+	Index int
+
+	// Err is the rejection returned by the node, nil when the transaction
+	// was accepted
+	Err error
+}
+
+// NewTxTree builds a tree of transactions spending args.Root, every
+// transaction spends one output of its parent and splits it into args.FanOut
+// outputs less the fee of its level. The transactions are returned level by
+// level, so every transaction comes after its parent.
+func NewTxTree(args *TxTreeArgs) ([]*TreeTx, error) {
+	pin.AssertNotNil("args.Root", args.Root)
+	pin.AssertNotNil("args.KeyRing", args.KeyRing)
+	pin.AssertTrue("args.Depth is not positive", args.Depth > 0)
+	pin.AssertTrue("args.FanOut is not positive", args.FanOut > 0)
+
+	pkScript, err := txscript.PayToAddrScript(args.PayTo)
+	if err != nil {
+		return nil, err
+	}
+
+	var tree []*TreeTx
+	type spendable struct {
+		output *SpendableOutput
+		parent int
+	}
+	level := []spendable{{output: args.Root, parent: -1}}
+	for depth := 0; depth < args.Depth; depth++ {
+		fee := int64(0)
+		if len(args.LevelFees) > 0 {
+			fee = args.LevelFees[len(args.LevelFees)-1]
+			if depth < len(args.LevelFees) {
+				fee = args.LevelFees[depth]
+			}
+		}
+
+		next := make([]spendable, 0, len(level)*args.FanOut)
+		for _, input := range level {
+			tx, txFee, err := splitOutput(args.KeyRing, input.output,
+				pkScript, args.FanOut, fee, args.AllowLowFees)
+			if err != nil {
+				return nil, fmt.Errorf("level %v: %v", depth, err)
+			}
+			hash := tx.TxHash()
+			tree = append(tree, &TreeTx{
+				Tx:     tx,
+				Hash:   &hash,
+				Level:  depth,
+				Parent: input.parent,
+				Fee:    txFee,
+			})
+			for i, txOut := range tx.TxOut {
+				next = append(next, spendable{
+					output: &SpendableOutput{
+						OutPoint: *wire.NewOutPoint(&hash,
+							uint32(i), wire.TxTreeRegular),
+						Value:       txOut.Value,
+						PkScript:    txOut.PkScript,
+						BlockHeight: wire.NullBlockHeight,
+						BlockIndex:  wire.NullBlockIndex,
+					},
+					parent: len(tree) - 1,
+				})
+			}
+		}
+		level = next
+	}
+	return tree, nil
+}
+
+// SubmitTxTree sends the transactions of the tree to the node in the passed
+// order and reports the outcome for each of them, in the order they were sent.
+// The seed drives the Shuffled order. Rejections are reported in the
+// submissions and are not errors.
+func SubmitTxTree(client coinharness.RPCClient, tree []*TreeTx, order SubmitOrder, seed int64) ([]*TxTreeSubmission, error) {
+	indexes := make([]int, len(tree))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	switch order {
+	case ParentsFirst:
+	case ChildrenFirst:
+		for i, j := 0, len(indexes)-1; i < j; i, j = i+1, j-1 {
+			indexes[i], indexes[j] = indexes[j], indexes[i]
+		}
+	case Shuffled:
+		rand.New(rand.NewSource(seed)).Shuffle(len(indexes),
+			func(i, j int) {
+				indexes[i], indexes[j] = indexes[j], indexes[i]
+			})
+	default:
+		return nil, fmt.Errorf("unknown submit order %v", order)
+	}
+
+	submissions := make([]*TxTreeSubmission, len(indexes))
+	for i, index := range indexes {
+		_, err := client.SendRawTransaction(
+			TransactionRawToTx(tree[index].Tx), true)
+		submissions[i] = &TxTreeSubmission{
+			Index: index,
+			Err:   err,
+		}
+	}
+	return submissions, nil
+}
+
+// GenerateTxTree builds the tree described by args with NewTxTree() and sends
+// it to the node with SubmitTxTree().
+func GenerateTxTree(client coinharness.RPCClient, args *TxTreeArgs, order SubmitOrder, seed int64) ([]*TreeTx, []*TxTreeSubmission, error) {
+	tree, err := NewTxTree(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	submissions, err := SubmitTxTree(client, tree, order, seed)
+	if err != nil {
+		return tree, nil, err
+	}
+	return tree, submissions, nil
+}
+
+// splitOutput returns the transaction spending the output into fanOut equal
+// outputs paying to pkScript less the fee, and the fee. A fee below
+// DefaultMinRelayTxFee for the size of the transaction is raised to it unless
+// a nonzero one is allowed to underpay with allowLowFee. An error is returned
+// when the fee does not settle.
+func splitOutput(ring *KeyRing, output *SpendableOutput, pkScript []byte, fanOut int, fee int64, allowLowFee bool) (*wire.MsgTx, int64, error) {
+	build := func(fee int64) (*wire.MsgTx, error) {
+		value := (output.Value - fee) / int64(fanOut)
+		if value <= 0 {
+			return nil, fmt.Errorf("output value %v does not cover "+
+				"the fee %v and %v outputs",
+				dcrutil.Amount(output.Value), dcrutil.Amount(fee),
+				fanOut)
+		}
+		outputs := make([]*wire.TxOut, fanOut)
+		for i := range outputs {
+			outputs[i] = wire.NewTxOut(value, pkScript)
+		}
+		// The remainder of the division goes to the fee.
+		return SpendOutputs(ring, []*SpendableOutput{output}, outputs)
+	}
+
+	if fee != 0 && allowLowFee {
+		tx, err := build(fee)
+		if err != nil {
+			return nil, 0, err
+		}
+		return tx, splitFee(output, tx), nil
+	}
+	for i := 0; i < maxFeeIterations; i++ {
+		tx, err := build(fee)
+		if err != nil {
+			return nil, 0, err
+		}
+		required := int64(DefaultMinRelayTxFee) *
+			int64(tx.SerializeSize()) / 1000
+		if required <= fee {
+			return tx, splitFee(output, tx), nil
+		}
+		fee = required
+	}
+	return nil, 0, fmt.Errorf("fee did not settle after %v signing "+
+		"iterations, last fee %v", maxFeeIterations, dcrutil.Amount(fee))
+}
+
+// splitFee returns the fee paid by the transaction spending the output.
+func splitFee(output *SpendableOutput, tx *wire.MsgTx) int64 {
+	totalOut := int64(0)
+	for _, txOut := range tx.TxOut {
+		totalOut += txOut.Value
+	}
+	return output.Value - totalOut
+}
@@ -0,0 +1,317 @@
+package btcharness
+
+import (
+	"fmt"
+
+	"github.com/jfixby/coinharness"
+	"github.com/jfixby/pin"
+	"github.com/picfight/pfcd/chaincfg"
+	"github.com/picfight/pfcd/dcrjson"
+	"github.com/picfight/pfcd/dcrutil"
+	"github.com/picfight/pfcd/rpcclient"
+	"github.com/picfight/pfcd/wire"
+)
+
+// CurrentBlockVersion is the GenerateBlockArgs.BlockVersion value selecting
+// the current default block version.
+const CurrentBlockVersion int32 = -1
+
+// DefaultBlockVersion returns the version of the blocks the node's own miner
+// generates for the network.
+func DefaultBlockVersion(net *chaincfg.Params) int32 {
+	switch net.Net {
+	case wire.PicfightCoinWire:
+		return 8
+	case wire.TestNet3, wire.RegNet:
+		return 7
+	}
+	return 6
+}
+
+// ResolveBlockVersion returns the block version and the stake version for a new
+// block on top of the node's best block. The block version is the network
+// default the node's own miner uses unless the chain has already moved to a
+// higher version. The stake version is calculated from the stake versions and
+// the votes of the node's chain with CalcNextStakeVersion, so it follows the
+// node at the stake version interval boundaries. Only the stake versions of the
+// last blocks are fetched, the window grows when the calculation reaches back
+// further.
+func ResolveBlockVersion(client coinharness.RPCClient, net *chaincfg.Params) (int32, uint32, error) {
+	rpc := client.Internal().(*rpcclient.Client)
+
+	tipHash, tipHeight, err := rpc.GetBestBlock()
+	if err != nil {
+		return 0, 0, err
+	}
+	count := stakeVersionWindow(net)
+	for {
+		if count > tipHeight+1 {
+			count = tipHeight + 1
+		}
+		history, err := rpc.GetStakeVersions(tipHash.String(),
+			int32(count))
+		if err != nil {
+			return 0, 0, err
+		}
+		if len(history.StakeVersions) == 0 {
+			return 0, 0, fmt.Errorf("no stake versions of block %v",
+				tipHash)
+		}
+		stakeVersion, err := CalcNextStakeVersion(history.StakeVersions,
+			net)
+		if _, missing := err.(missingStakeVersionsError); missing &&
+			count < tipHeight+1 {
+			// The vote majority is searched for before the window.
+			count *= 2
+			continue
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		blockVersion := DefaultBlockVersion(net)
+		if tip := history.StakeVersions[0]; tip.BlockVersion > blockVersion {
+			blockVersion = tip.BlockVersion
+		}
+		return blockVersion, stakeVersion, nil
+	}
+}
+
+// stakeVersionWindow returns the number of blocks back from the tip
+// CalcNextStakeVersion reads when the votes of the prior stake version interval
+// have a majority: that interval, the one before it for the lock-in of the
+// header versions and the block versions checked for the upgrade, on top of
+// the blocks of the current interval.
+func stakeVersionWindow(net *chaincfg.Params) int64 {
+	return 3*net.StakeVersionInterval + int64(net.BlockUpgradeNumToCheck)
+}
+
+// missingStakeVersionsError is returned by CalcNextStakeVersion when the passed
+// stake versions do not reach back to the block at the height it holds.
+type missingStakeVersionsError int64
+
+func (e missingStakeVersionsError) Error() string {
+	return fmt.Sprintf("stake versions of block %v are missing", int64(e))
+}
+
+// CalcNextStakeVersion calculates the header stake version of the block after
+// the first of the passed stake versions the same way the node does. The stake
+// versions are ordered from the tip backwards as returned by getstakeversions.
+// An error is returned when they do not reach back far enough, which is
+// further than stakeVersionWindow blocks only while no interval of the window
+// has a majority of the votes on a version.
+func CalcNextStakeVersion(history []dcrjson.StakeVersions, net *chaincfg.Params) (uint32, error) {
+	if len(history) == 0 {
+		return 0, fmt.Errorf("no stake versions to calculate the next " +
+			"one from")
+	}
+	tipHeight := history[0].Height
+	// at returns the stake versions of the block at the passed height,
+	// nil below the genesis block.
+	at := func(height int64) (*dcrjson.StakeVersions, error) {
+		if height < 0 {
+			return nil, nil
+		}
+		index := tipHeight - height
+		if index < 0 || index >= int64(len(history)) {
+			return nil, missingStakeVersionsError(height)
+		}
+		return &history[index], nil
+	}
+
+	svh := net.StakeValidationHeight
+	svi := net.StakeVersionInterval
+	// priorHeight returns the height of the final block of the stake
+	// version interval before the one of the block after the passed
+	// height, false if there is no such interval yet.
+	priorHeight := func(prevHeight int64) (int64, bool) {
+		nextHeight := prevHeight + 1
+		if nextHeight < svh+svi {
+			return 0, false
+		}
+		return calcWantHeight(svh, svi, nextHeight), true
+	}
+	// tally walks an interval back from the passed height and counts the
+	// versions picked from the blocks along with their total.
+	tally := func(height int64, versions func(*dcrjson.StakeVersions) []uint32) (map[uint32]int32, int32, error) {
+		counts := make(map[uint32]int32)
+		total := int32(0)
+		for i := int64(0); i < svi; i++ {
+			entry, err := at(height - i)
+			if err != nil {
+				return nil, 0, err
+			}
+			if entry == nil {
+				break
+			}
+			for _, version := range versions(entry) {
+				counts[version]++
+				total++
+			}
+		}
+		return counts, total, nil
+	}
+	majority := func(counts map[uint32]int32, total int32) (uint32, bool) {
+		required := total * net.StakeMajorityMultiplier /
+			net.StakeMajorityDivisor
+		for version, count := range counts {
+			if count >= required {
+				return version, true
+			}
+		}
+		return 0, false
+	}
+	headerVersion := func(entry *dcrjson.StakeVersions) []uint32 {
+		return []uint32{entry.StakeVersion}
+	}
+	voteVersions := func(entry *dcrjson.StakeVersions) []uint32 {
+		versions := make([]uint32, 0, len(entry.Votes))
+		for _, vote := range entry.Votes {
+			versions = append(versions, vote.Version)
+		}
+		return versions
+	}
+
+	// Find the last interval with a majority of the votes on a version.
+	var version uint32
+	found := false
+	height, ok := priorHeight(tipHeight)
+	for ok && height >= svh {
+		counts, total, err := tally(height, voteVersions)
+		if err != nil {
+			return 0, err
+		}
+		version, found = majority(counts, total)
+		if found {
+			break
+		}
+		height -= svi
+	}
+	if !found || version == 0 {
+		return 0, nil
+	}
+
+	// The stake version is not enforced until the majority of the blocks
+	// is version 3.
+	start := calcWantHeight(svh, svi, height) + 1
+	blocksFound := uint64(0)
+	for i := uint64(0); i < net.BlockUpgradeNumToCheck &&
+		blocksFound < net.BlockRejectNumRequired; i++ {
+		entry, err := at(start - int64(i))
+		if err != nil {
+			return 0, err
+		}
+		if entry == nil {
+			break
+		}
+		if entry.BlockVersion >= 3 {
+			blocksFound++
+		}
+	}
+	if blocksFound < net.BlockRejectNumRequired {
+		return 0, nil
+	}
+
+	// The stake version does not go backwards once it has been locked in
+	// by a majority of the headers of the prior interval.
+	prior, ok := priorHeight(height)
+	if !ok {
+		return version, nil
+	}
+	counts, _, err := tally(prior, headerVersion)
+	if err != nil {
+		return 0, err
+	}
+	versionCount := int32(0)
+	for headerVersion, count := range counts {
+		if headerVersion >= version {
+			versionCount += count
+		}
+	}
+	required := int32(svi) * net.StakeMajorityMultiplier /
+		net.StakeMajorityDivisor
+	if versionCount >= required {
+		priorVersion, _ := majority(counts, int32(svi))
+		if priorVersion > version {
+			version = priorVersion
+		}
+	}
+	return version, nil
+}
+
+// calcWantHeight calculates the height of the final block of the stake version
+// interval before the passed height.
+func calcWantHeight(stakeValidationHeight, interval, height int64) int64 {
+	// The intervals start at the stake validation height, which is not
+	// necessarily a multiple of the interval.
+	intervalOffset := stakeValidationHeight % interval
+	adjustedHeight := height - intervalOffset - 1
+	return (adjustedHeight - ((adjustedHeight + 1) % interval)) +
+		intervalOffset
+}
+
+// BlockVersionSchedule is an entry of a schedule of block versions mined by
+// GenerateVersionedBlocks()
+type BlockVersionSchedule struct {
+	// Count is the number of blocks mined with the versions
+	Count int
+
+	// BlockVersion of the blocks, CurrentBlockVersion means the version
+	// resolved with ResolveBlockVersion
+	BlockVersion int32
+
+	// StakeVersion of the blocks, zero means the stake version of
+	// args.StakeState is kept
+	StakeVersion uint32
+}
+
+// GenerateVersionedBlocks mines and submits blocks following the passed
+// schedule of versions, every block is built from a copy of args. It returns
+// the submitted blocks or the blocks submitted before an error occurred.
+func GenerateVersionedBlocks(client coinharness.RPCClient, schedule []BlockVersionSchedule, args *GenerateBlockArgs) ([]*dcrutil.Block, error) {
+	var blocks []*dcrutil.Block
+	for _, entry := range schedule {
+		pin.AssertTrue(fmt.Sprintf("Incorrect BlockVersion(%v)",
+			entry.BlockVersion), entry.BlockVersion > 0 ||
+			entry.BlockVersion == CurrentBlockVersion)
+		for i := 0; i < entry.Count; i++ {
+			blockArgs, err := scheduledBlockArgs(client, entry, args)
+			if err != nil {
+				return blocks, err
+			}
+			block, err := GenerateAndSubmitBlockWithCustomCoinbaseOutputs(
+				client, blockArgs)
+			if err != nil {
+				return blocks, err
+			}
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks, nil
+}
+
+// scheduledBlockArgs returns a copy of args building a block with the versions
+// of the passed schedule entry. The stake state is fetched from the node when
+// args.FollowStakeState is set, otherwise a nil args.StakeState is replaced
+// with one carrying only the scheduled stake version.
+func scheduledBlockArgs(client coinharness.RPCClient, entry BlockVersionSchedule, args *GenerateBlockArgs) (*GenerateBlockArgs, error) {
+	blockArgs := *args
+	blockArgs.BlockVersion = entry.BlockVersion
+	if entry.StakeVersion == 0 {
+		return &blockArgs, nil
+	}
+	stakeState := blockArgs.StakeState
+	if stakeState == nil && blockArgs.FollowStakeState {
+		var err error
+		stakeState, err = FetchStakeState(client, blockArgs.Network)
+		if err != nil {
+			return nil, err
+		}
+	}
+	withVersion := StakeState{}
+	if stakeState != nil {
+		withVersion = *stakeState
+	}
+	withVersion.StakeVersion = entry.StakeVersion
+	blockArgs.StakeState = &withVersion
+	return &blockArgs, nil
+}